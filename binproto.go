@@ -4,9 +4,13 @@ package binproto
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"io"
 	"net"
 	"net/textproto"
+	"sync"
+	"time"
 )
 
 // A Conn represents a binary network protocol connection.
@@ -17,17 +21,407 @@ type Conn struct {
 	Reader
 	Writer
 	textproto.Pipeline
-	conn io.ReadWriteCloser
+	conn      io.ReadWriteCloser
+	br        *bufio.Reader
+	config    ConnConfig
+	idle      bool
+	ka        *keepalive
+	closeOnce sync.Once
+
+	hsMu       sync.Mutex
+	hsDone     uint32
+	hsErr      error
+	negotiated Negotiated
+}
+
+// ConnConfig configures a Conn.
+type ConnConfig struct {
+	// ReadBufferSize and WriteBufferSize are the sizes of the read
+	// and write buffers. If zero, 4096 bytes are allocated.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// MaxMessageSize is the maximum payload size of a message which
+	// can be read. If zero, 8 MiB is used.
+	MaxMessageSize int
+
+	// ReadTimeout is the maximum duration for reading a message, and
+	// WriteTimeout is the maximum duration of writing messages with
+	// the write methods of the Conn, such as WriteMessage or Send. Timeouts are only applied when the underlying
+	// connection has SetReadDeadline and SetWriteDeadline methods.
+	// If zero, there is no timeout.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// IdleTimeout is the maximum amount of time to wait for the next
+	// message, after which ReadTimeout applies. If zero, the value of
+	// ReadTimeout is used for the whole message.
+	IdleTimeout time.Duration
+
+	// Dialer is used by DialConfig and DialContext.
+	// If nil, a zero Dialer is used.
+	Dialer *net.Dialer
+
+	// OnRead and OnWrite, if not nil, are called with every message
+	// read with ReadMessage or written with WriteMessage or Buffer.
+	// OnWrite is called with the messages of WriteMessageFrom as well,
+	// without their payload.
+	OnRead  func(*Message)
+	OnWrite func(*Message)
+
+	// OnClose, if not nil, is called once when the Conn is closed.
+	OnClose func()
+
+	// KeepAlive is the interval of the pings sent to check that the peer
+	// is alive. Pings and their replies are control messages with the
+	// reserved ID 2^60-1, which are handled by the Conn and not returned
+	// by ReadMessage, so keepalive must be enabled at both ends. Replies
+	// are only received while reading from the Conn.
+	// If zero, no pings are sent.
+	KeepAlive time.Duration
+
+	// KeepAliveMissed is the number of consecutive pings the peer may
+	// leave unanswered, after which the Conn is closed and its reads
+	// fail with ErrPeerTimeout. Any message from the peer counts as
+	// an answer. If zero, 3 is used.
+	KeepAliveMissed int
+
+	// Handshake enables the opening handshake, see Conn.Handshake.
+	// It must be enabled at both ends. Capabilities is the set of
+	// capabilities offered in it.
+	Handshake    bool
+	Capabilities Capabilities
+
+	// Compression enables the compression framing, see
+	// WriterOptions.Compressed, and is the codec payloads of at least
+	// CompressionThreshold bytes are compressed with. With the handshake,
+	// CapCompression is offered and the framing is only used if the peer
+	// offers it too, otherwise it must be enabled at both ends.
+	// Only the capability is negotiated, not the codec: each payload
+	// names its codec, and one the peer has not registered fails its
+	// reads with ErrUnknownCompression. Both ends should use a codec
+	// the other has registered, such as a built-in one.
+	// MaxDecompressedSize limits the size of decompressed payloads.
+	Compression          Compression
+	CompressionThreshold int
+	MaxDecompressedSize  int
+
+	// Checksum enables CRC-32C frame checksums, see WriterOptions.Checksum.
+	// With the handshake, CapChecksum is offered and checksums are only
+	// used if the peer offers it too, otherwise they must be enabled at
+	// both ends.
+	Checksum bool
+
+	// SelfSync enables the self-synchronizing framing, see
+	// WriterOptions.SelfSync, which must be enabled at both ends, as
+	// the handshake is sent in it. OnSkip, if not nil, is called with
+	// the number of bytes skipped when looking for the next valid frame.
+	SelfSync bool
+	OnSkip   func(n int)
 }
 
 // NewConn returns a new Conn using conn for I/O.
 func NewConn(conn io.ReadWriteCloser) *Conn {
-	r, w := NewReaderSize(bufio.NewReader(conn), 16), NewWriter(bufio.NewWriter(conn))
-	return &Conn{
-		Reader: *r,
-		Writer: *w,
-		conn:   conn,
+	return NewConnConfig(conn, nil)
+}
+
+// NewConnConfig returns a new Conn using conn for I/O, configured by
+// config. A nil config is equivalent to a zero ConnConfig.
+func NewConnConfig(conn io.ReadWriteCloser, config *ConnConfig) *Conn {
+	c := &Conn{conn: conn}
+	if config != nil {
+		c.config = *config
+	}
+	c.br = bufio.NewReader(connReader{c})
+	c.Reader.init(c.br, &ReaderOptions{
+		BufferSize:     c.config.ReadBufferSize,
+		MaxMessageSize: c.config.MaxMessageSize,
+		SelfSync:       c.config.SelfSync,
+		OnSkip:         c.config.OnSkip,
+	})
+	c.Writer.init(conn, &WriterOptions{
+		BufferSize:     c.config.WriteBufferSize,
+		SelfSync:       c.config.SelfSync,
+		MaxMessageSize: c.config.MaxMessageSize,
+	})
+	if c.config.Compression != CompressionNone {
+		c.config.Capabilities |= CapCompression
+		if !c.config.Handshake {
+			c.enableCompression()
+		}
+	}
+	if c.config.Checksum {
+		c.config.Capabilities |= CapChecksum
+		if !c.config.Handshake {
+			c.enableChecksum()
+		}
+	}
+	if c.config.KeepAlive > 0 {
+		c.ka = newKeepalive(c, c.config.KeepAlive, c.config.KeepAliveMissed)
+		go c.ka.run()
+	}
+	return c
+}
+
+// enableCompression switches the Conn to the compression framing.
+func (c *Conn) enableCompression() {
+	c.Reader.setCompression(c.config.MaxDecompressedSize)
+	c.Writer.mu.Lock()
+	c.Writer.setCompression(c.config.Compression, c.config.CompressionThreshold)
+	c.Writer.mu.Unlock()
+}
+
+// enableChecksum switches the Conn to checksummed frames.
+func (c *Conn) enableChecksum() {
+	c.Reader.setChecksum(true)
+	c.Writer.mu.Lock()
+	c.Writer.checksum = true
+	c.Writer.mu.Unlock()
+}
+
+// connReader reads from the connection of a Conn, switching from
+// the idle timeout to the read timeout once a message begins. Any
+// bytes read keep the peer alive for keepalive, such as those of a
+// large payload streamed with NextMessage.
+type connReader struct {
+	c *Conn
+}
+
+func (r connReader) Read(p []byte) (int, error) {
+	c := r.c
+	n, err := c.conn.Read(p)
+	if n > 0 && c.idle {
+		c.idle = false
+		c.setReadDeadline(c.config.ReadTimeout)
+	}
+	if n > 0 && c.ka != nil {
+		c.ka.received()
+	}
+	return n, err
+}
+
+// ReadMessage reads a single message, applying the read and idle
+// timeouts of the Conn.
+func (c *Conn) ReadMessage() (*Message, error) {
+	if err := c.autoHandshake(context.Background()); err != nil {
+		return nil, err
+	}
+	defer c.startRead()()
+	return c.readMessage()
+}
+
+// NextMessage reads the header of the next message and returns it
+// along with a reader for its payload, as Reader.NextMessage does,
+// applying the read and idle timeouts of the Conn to the header.
+// Control messages are handled as with ReadMessage.
+func (c *Conn) NextMessage() (*Message, io.Reader, error) {
+	if err := c.autoHandshake(context.Background()); err != nil {
+		return nil, nil, err
+	}
+	defer c.startRead()()
+	for {
+		m, body, err := c.Reader.NextMessage()
+		if err != nil {
+			return nil, nil, c.readError(err)
+		}
+		if c.ka != nil {
+			c.ka.received()
+		}
+		if m.ID != controlID || !c.control() {
+			return m, body, nil
+		}
+		if body.(interface{ Len() int }).Len() > c.Reader.d.maxMsg {
+			return nil, nil, &MessageError{ID: m.ID, Channel: m.Channel, Err: ErrMessageSizeExceeded}
+		}
+		if m.Data, err = readAll(body, nil); err != nil {
+			return nil, nil, c.readError(err)
+		}
+		if !c.handleControl(m) {
+			return m, bytes.NewReader(m.Data), nil
+		}
+	}
+}
+
+// startRead applies the read and idle timeouts of the Conn to reading
+// the next message, and returns a function clearing them.
+func (c *Conn) startRead() func() {
+	if c.config.ReadTimeout <= 0 && c.config.IdleTimeout <= 0 {
+		return func() {}
+	}
+	c.idle = c.config.IdleTimeout > 0 && c.Reader.idle() && c.br.Buffered() == 0
+	if c.idle {
+		c.setReadDeadline(c.config.IdleTimeout)
+	} else {
+		c.setReadDeadline(c.config.ReadTimeout)
+	}
+	return func() {
+		c.idle = false
+		c.setReadDeadline(0)
+	}
+}
+
+// readError returns the error of keepalive, if it closed the Conn,
+// instead of the read error err it caused.
+func (c *Conn) readError(err error) error {
+	if c.ka != nil {
+		if kerr := c.ka.error(); kerr != nil {
+			return kerr
+		}
+	}
+	return err
+}
+
+func (c *Conn) readMessage() (*Message, error) {
+	for {
+		m, err := c.Reader.ReadMessage()
+		if err != nil {
+			return nil, c.readError(err)
+		}
+		if c.ka != nil {
+			c.ka.received()
+		}
+		if m.ID == controlID && c.control() && c.handleControl(m) {
+			m.Release()
+			continue
+		}
+		if c.config.OnRead != nil {
+			c.config.OnRead(m)
+		}
+		return m, nil
+	}
+}
+
+// WriteMessage writes messages and flushes them, applying the write
+// timeout of the Conn.
+func (c *Conn) WriteMessage(messages ...*Message) error {
+	if err := c.autoHandshake(context.Background()); err != nil {
+		return err
+	}
+	defer c.setWriteDeadline()()
+	return c.writeMessage(messages)
+}
+
+// writeControl writes a control message of a layer above the Conn,
+// such as a Session, applying the write timeout of the Conn.
+func (c *Conn) writeControl(m *Message) error {
+	if err := c.autoHandshake(context.Background()); err != nil {
+		return err
+	}
+	defer c.setWriteDeadline()()
+	return c.Writer.WriteMessage(m)
+}
+
+// setWriteDeadline sets the write deadline of the connection from
+// the write timeout, and returns a function clearing it.
+func (c *Conn) setWriteDeadline() func() {
+	if c.config.WriteTimeout > 0 {
+		if d, ok := c.conn.(interface{ SetWriteDeadline(time.Time) error }); ok {
+			d.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+			return func() { d.SetWriteDeadline(time.Time{}) }
+		}
+	}
+	return func() {}
+}
+
+// Buffer writes messages to the write buffer without flushing them,
+// as Writer.Buffer does, applying the write timeout of the Conn to the
+// parts written when the buffer fills up.
+func (c *Conn) Buffer(messages ...*Message) error {
+	if err := c.autoHandshake(context.Background()); err != nil {
+		return err
+	}
+	if err := c.checkWrite(messages); err != nil {
+		return err
+	}
+	defer c.setWriteDeadline()()
+	err := c.Writer.Buffer(messages...)
+	if err == nil {
+		c.wrote(messages)
 	}
+	return err
+}
+
+// Flush writes any buffered data, applying the write timeout of the Conn.
+func (c *Conn) Flush() error {
+	if err := c.autoHandshake(context.Background()); err != nil {
+		return err
+	}
+	defer c.setWriteDeadline()()
+	return c.Writer.Flush()
+}
+
+// WriteMessageFrom writes a single message whose payload of the given
+// length is copied from r, as Writer.WriteMessageFrom does, applying
+// the write timeout of the Conn.
+func (c *Conn) WriteMessageFrom(id int, ch rune, length int, r io.Reader) error {
+	if err := c.autoHandshake(context.Background()); err != nil {
+		return err
+	}
+	m := []*Message{{ID: id, Channel: ch}}
+	if err := c.checkWrite(m); err != nil {
+		return err
+	}
+	if n, ok := c.Negotiated(); ok && n.MaxMessageSize > 0 && length > n.MaxMessageSize {
+		return &MessageError{ID: id, Channel: ch, Err: ErrMessageSizeExceeded}
+	}
+	defer c.setWriteDeadline()()
+	err := c.Writer.WriteMessageFrom(id, ch, length, r)
+	if err == nil {
+		c.wrote(m)
+	}
+	return err
+}
+
+func (c *Conn) writeMessage(messages []*Message) error {
+	if err := c.checkWrite(messages); err != nil {
+		return err
+	}
+	err := c.Writer.WriteMessage(messages...)
+	if err == nil {
+		c.wrote(messages)
+	}
+	return err
+}
+
+// checkWrite returns a *MessageError for the first of messages which
+// must not be written on c.
+func (c *Conn) checkWrite(messages []*Message) error {
+	if c.control() {
+		if err := reserveControlID(messages); err != nil {
+			return err
+		}
+	}
+	if n, ok := c.Negotiated(); ok && n.MaxMessageSize > 0 {
+		for i, m := range messages {
+			if len(m.Data) > n.MaxMessageSize {
+				return &MessageError{Index: i, ID: m.ID, Channel: m.Channel, Err: ErrMessageSizeExceeded}
+			}
+		}
+	}
+	return nil
+}
+
+// wrote reports messages written on c to OnWrite.
+func (c *Conn) wrote(messages []*Message) {
+	if c.config.OnWrite != nil {
+		for _, m := range messages {
+			c.config.OnWrite(m)
+		}
+	}
+}
+
+// setReadDeadline sets the read deadline of the connection to timeout
+// from now, or clears it if timeout is zero.
+func (c *Conn) setReadDeadline(timeout time.Duration) {
+	d, ok := c.conn.(interface{ SetReadDeadline(time.Time) error })
+	if !ok {
+		return
+	}
+	var t time.Time
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+	d.SetReadDeadline(t)
 }
 
 // Send is a convenience method that sends a variable number of messages
@@ -44,17 +438,153 @@ func (c *Conn) Send(m ...*Message) (id uint, err error) {
 	return id, nil
 }
 
+// SendContext is like Send, but writing the messages is interrupted
+// when ctx is done, in which case ctx.Err() is returned. The connection
+// should not be used for writing after that, as a message may have been
+// partially written.
+//
+// The WriteTimeout of the Conn applies as well.
+// If the underlying connection has no SetWriteDeadline method,
+// ctx is only checked before writing.
+func (c *Conn) SendContext(ctx context.Context, m ...*Message) (id uint, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := c.autoHandshake(ctx); err != nil {
+		return 0, err
+	}
+	if c.config.WriteTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.WriteTimeout)
+		defer cancel()
+	}
+	id = c.Next()
+	c.StartRequest(id)
+	if d, ok := c.conn.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		stop := watchContext(ctx, d.SetWriteDeadline)
+		err = stop(c.writeMessage(m))
+	} else {
+		err = c.writeMessage(m)
+	}
+	c.EndRequest(id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// ReadMessageContext is like ReadMessage, but reading is interrupted
+// when ctx is done, in which case ctx.Err() is returned. The bytes of
+// a message which were read before the interruption are kept, so the
+// connection can still be used for reading.
+//
+// The ReadTimeout of the Conn applies, but not its IdleTimeout.
+// If the underlying connection has no SetReadDeadline method,
+// ctx is only checked before reading.
+func (c *Conn) ReadMessageContext(ctx context.Context) (*Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := c.autoHandshake(ctx); err != nil {
+		return nil, err
+	}
+	d, ok := c.conn.(interface{ SetReadDeadline(time.Time) error })
+	if !ok {
+		return c.readMessage()
+	}
+	if c.config.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.ReadTimeout)
+		defer cancel()
+	}
+	stop := watchContext(ctx, d.SetReadDeadline)
+	m, err := c.readMessage()
+	return m, stop(err)
+}
+
+// watchContext applies the deadline of ctx with setDeadline, and sets
+// a deadline in the past to interrupt I/O when ctx is canceled.
+// The returned function must be called with the result of the I/O once
+// it is over. It clears the deadline and returns ctx.Err() instead of
+// the error if the I/O was interrupted.
+func watchContext(ctx context.Context, setDeadline func(time.Time) error) (stop func(error) error) {
+	deadline, hasDeadline := ctx.Deadline()
+	done := ctx.Done()
+	if !hasDeadline && done == nil {
+		return func(err error) error { return err }
+	}
+	if hasDeadline {
+		setDeadline(deadline)
+	}
+
+	stopc, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-done:
+			setDeadline(aLongTimeAgo)
+		case <-stopc:
+		}
+	}()
+
+	return func(err error) error {
+		close(stopc)
+		<-exited
+		setDeadline(time.Time{})
+		if err == nil {
+			return nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		// The deadline of the connection may expire just before
+		// the one of ctx.
+		if hasDeadline && isTimeout(err) && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+		return err
+	}
+}
+
 // Close closes the connection.
 func (c *Conn) Close() error {
-	return c.conn.Close()
+	if c.ka != nil {
+		c.ka.stop()
+	}
+	err := c.conn.Close()
+	if c.config.OnClose != nil {
+		c.closeOnce.Do(c.config.OnClose)
+	}
+	return err
 }
 
 // Dial connects to the given address on the given network using net.Dial
 // and then returns a new Conn for the connection.
 func Dial(network, addr string) (*Conn, error) {
-	c, err := net.Dial(network, addr)
+	return DialContext(context.Background(), network, addr, nil)
+}
+
+// DialConfig connects to the given address on the given network using
+// the Dialer of config, and then returns a new Conn for the connection
+// configured by config.
+func DialConfig(network, addr string, config *ConnConfig) (*Conn, error) {
+	return DialContext(context.Background(), network, addr, config)
+}
+
+// DialContext is like DialConfig, using the provided context
+// for connecting and for the handshake, if it is enabled.
+func DialContext(ctx context.Context, network, addr string, config *ConnConfig) (*Conn, error) {
+	var d net.Dialer
+	if config != nil && config.Dialer != nil {
+		d = *config.Dialer
+	}
+	nc, err := d.DialContext(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
-	return NewConn(c), nil
+	c := NewConnConfig(nc, config)
+	if err := c.Handshake(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
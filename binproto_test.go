@@ -0,0 +1,183 @@
+package binproto_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/onur1/binproto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadMessageContext(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := binproto.NewConn(a)
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.ReadMessageContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	// Interrupted before any bytes.
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = c.ReadMessageContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// Interrupted in the middle of a message.
+	data := newBytes(42, 3, 100, 0, 0)
+	go b.Write(data[:50])
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	_, err = c.ReadMessageContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	go b.Write(data[50:])
+
+	m, err := c.ReadMessageContext(context.Background())
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(42, 3, 100), m)
+}
+
+func TestSendContext(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := binproto.NewConn(a)
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.SendContext(ctx, newMessage(42, 3, 2))
+	assert.Equal(t, context.Canceled, err)
+
+	// Nobody is reading the other end.
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = c.SendContext(ctx, newMessage(42, 3, 2))
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	d := binproto.NewConn(b)
+	go func() {
+		c2 := binproto.NewConn(a)
+		c2.SendContext(context.Background(), newMessage(42, 3, 2))
+	}()
+	m, err := d.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(42, 3, 2), m)
+}
+
+func isTimeout(err error) bool {
+	var t interface{ Timeout() bool }
+	return errors.As(err, &t) && t.Timeout()
+}
+
+func TestConnConfigTimeouts(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := binproto.NewConnConfig(a, &binproto.ConnConfig{
+		ReadTimeout: 20 * time.Millisecond,
+		IdleTimeout: 500 * time.Millisecond,
+	})
+	defer c.Close()
+
+	// The read timeout applies once a message begins.
+	data := newBytes(42, 3, 100, 0, 0)
+	go b.Write(data[:50])
+
+	start := time.Now()
+	_, err := c.ReadMessage()
+	assert.True(t, isTimeout(err))
+	assert.Less(t, int64(time.Since(start)), int64(400*time.Millisecond))
+
+	go b.Write(data[50:])
+
+	m, err := c.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(42, 3, 100), m)
+
+	// The idle timeout applies while waiting for a message.
+	c = binproto.NewConnConfig(a, &binproto.ConnConfig{IdleTimeout: 20 * time.Millisecond})
+	_, err = c.ReadMessage()
+	assert.True(t, isTimeout(err))
+
+	c = binproto.NewConnConfig(a, &binproto.ConnConfig{WriteTimeout: 20 * time.Millisecond})
+	assert.True(t, isTimeout(c.WriteMessage(newMessage(42, 3, 2))))
+}
+
+func TestConnConfigHooks(t *testing.T) {
+	var reads, writes, closes int
+
+	config := &binproto.ConnConfig{
+		OnRead:  func(*binproto.Message) { reads++ },
+		OnWrite: func(*binproto.Message) { writes++ },
+		OnClose: func() { closes++ },
+	}
+
+	a, b := net.Pipe()
+	c, d := binproto.NewConnConfig(a, config), binproto.NewConnConfig(b, config)
+
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		c.Send(newMessage(42, 3, 2), newMessage(42, 3, 2))
+	}()
+	for i := 0; i < 2; i++ {
+		_, err := d.ReadMessage()
+		assert.Nil(t, err)
+	}
+	<-sent
+
+	c.Close()
+	c.Close()
+	d.Close()
+
+	assert.Equal(t, 2, reads)
+	assert.Equal(t, 2, writes)
+	assert.Equal(t, 2, closes)
+}
+
+func TestDialContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		rwc, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c := binproto.NewConn(rwc)
+		defer c.Close()
+		m, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.Send(m)
+	}()
+
+	c, err := binproto.DialConfig("tcp", l.Addr().String(), &binproto.ConnConfig{
+		Dialer:       &net.Dialer{Timeout: time.Second},
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+	})
+	assert.Nil(t, err)
+	defer c.Close()
+
+	_, err = c.Send(newMessage(42, 3, 2))
+	assert.Nil(t, err)
+	m, err := c.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(42, 3, 2), m)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = binproto.DialContext(ctx, "tcp", l.Addr().String(), nil)
+	assert.NotNil(t, err)
+}
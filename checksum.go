@@ -0,0 +1,40 @@
+package binproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// checksumSize is the size of the CRC-32C trailer of checksummed frames,
+// which covers the length and header varints and the payload.
+const checksumSize = 4
+
+var ErrChecksumMismatch = errors.New("binproto: checksum mismatch")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func appendChecksum(dst []byte, crc uint32) []byte {
+	var b [checksumSize]byte
+	binary.BigEndian.PutUint32(b[:], crc)
+	return append(dst, b[:]...)
+}
+
+// verifyChecksum verifies the trailer of the payload of a checksummed
+// frame and returns the payload without it.
+func verifyChecksum(id int, ch rune, data []byte) ([]byte, error) {
+	if len(data) < checksumSize {
+		return nil, ErrChecksumMismatch
+	}
+	n := len(data) - checksumSize
+
+	header := uint64(id)<<4 | uint64(ch)
+	var hdr [2 * maxVarintLen]byte
+	b := appendHeader(hdr[:0], header, len(data))
+
+	crc := crc32.Update(crc32.Checksum(b, castagnoli), castagnoli, data[:n])
+	if crc != binary.BigEndian.Uint32(data[n:]) {
+		return nil, ErrChecksumMismatch
+	}
+	return data[:n], nil
+}
@@ -0,0 +1,118 @@
+package binproto_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/onur1/binproto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksum(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		var buf bytes.Buffer
+		w := binproto.NewWriterOptions(&buf, &binproto.WriterOptions{
+			Checksum:    true,
+			Compressed:  compressed,
+			Compression: binproto.CompressionFlate,
+		})
+		// Large payloads are written with net.Buffers without compression.
+		assert.Nil(t, w.WriteMessage(newMessage(42, 3, 2), newMessage(7, 1, 5000), newMessage(0, 0, 0)))
+		assert.Nil(t, w.WriteMessageFrom(5, 10, 100, bytes.NewReader([]byte(fill(100)))))
+
+		r := binproto.NewReaderOptions(&buf, &binproto.ReaderOptions{
+			Checksum:   true,
+			Compressed: compressed,
+		})
+		for _, expected := range []*binproto.Message{
+			newMessage(42, 3, 2),
+			newMessage(7, 1, 5000),
+			newMessage(0, 0, 0),
+		} {
+			m, err := r.ReadMessage()
+			assert.Nil(t, err)
+			assert.Equal(t, expected.ID, m.ID)
+			assert.Equal(t, expected.Channel, m.Channel)
+			assert.Equal(t, len(expected.Data), len(m.Data))
+			assert.Equal(t, string(expected.Data), string(m.Data))
+		}
+
+		m, body, err := r.NextMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, 5, m.ID)
+		data, err := io.ReadAll(body)
+		assert.Nil(t, err)
+		assert.Equal(t, fill(100), string(data))
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	w := binproto.NewWriterOptions(&buf, &binproto.WriterOptions{Checksum: true})
+	assert.Nil(t, w.WriteMessage(newMessage(42, 3, 10)))
+	n := buf.Len()
+	assert.Nil(t, w.WriteMessage(newMessage(42, 3, 10), newMessage(7, 1, 2)))
+
+	data := buf.Bytes()
+	data[5] ^= 0x10   // payload of the first frame
+	data[n+1] ^= 0x01 // channel of the second frame
+
+	r := binproto.NewReaderOptions(bytes.NewReader(data), &binproto.ReaderOptions{Checksum: true})
+
+	var merr *binproto.MessageError
+	_, err := r.ReadMessage()
+	assert.True(t, errors.As(err, &merr))
+	assert.Equal(t, binproto.ErrChecksumMismatch, merr.Err)
+	assert.Equal(t, 42, merr.ID)
+	assert.Equal(t, rune(3), merr.Channel)
+
+	_, err = r.ReadMessage()
+	assert.True(t, errors.As(err, &merr))
+	assert.Equal(t, binproto.ErrChecksumMismatch, merr.Err)
+	assert.Equal(t, rune(2), merr.Channel)
+
+	m, err := r.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(7, 1, 2), m)
+}
+
+func TestConnChecksum(t *testing.T) {
+	a, b := net.Pipe()
+	c := binproto.NewConnConfig(a, &binproto.ConnConfig{Handshake: true, Checksum: true})
+	defer c.Close()
+	d := binproto.NewConnConfig(b, &binproto.ConnConfig{Handshake: true, Checksum: true})
+	defer d.Close()
+
+	go c.Send(newMessage(42, 3, 2))
+	m, err := d.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(42, 3, 2), m)
+
+	n, _ := c.Negotiated()
+	assert.Equal(t, binproto.CapChecksum, n.Capabilities)
+}
+
+func TestChecksumMaxMessageSize(t *testing.T) {
+	var buf bytes.Buffer
+	w := binproto.NewWriterOptions(&buf, &binproto.WriterOptions{Checksum: true})
+	assert.Nil(t, w.WriteMessage(newMessage(1, 0, 1024), newMessage(2, 0, 1025)))
+
+	r := binproto.NewReaderOptions(&buf, &binproto.ReaderOptions{Checksum: true, MaxMessageSize: 1024})
+	m, err := r.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(1, 0, 1024), m)
+	_, err = r.ReadMessage()
+	assert.Equal(t, binproto.ErrMessageSizeExceeded, err)
+}
+
+func TestChecksumBogusLength(t *testing.T) {
+	// A length varint of 2^63-1, followed by a header.
+	data := append(bytes.Repeat([]byte{0xff}, 8), 0x7f, 0x10)
+
+	r := binproto.NewReaderOptions(bytes.NewReader(data), &binproto.ReaderOptions{Checksum: true})
+	_, _, err := r.NextMessage()
+	assert.ErrorIs(t, err, binproto.ErrMessageSizeExceeded)
+}
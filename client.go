@@ -0,0 +1,146 @@
+package binproto
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrClientClosed = errors.New("binproto: client closed")
+
+// A Client sends requests on a Conn and matches each response to its
+// request by Message.ID. A Client is safe for concurrent use by multiple
+// goroutines.
+//
+// The Client owns the reading side of the Conn. Messages whose ID does
+// not belong to a pending call, such as responses to calls which have
+// been canceled, are discarded.
+type Client struct {
+	conn *Conn
+
+	mu      sync.Mutex
+	nextID  int
+	pending map[int]chan *Message
+	closing bool
+	err     error
+	done    chan struct{}
+}
+
+// NewClient returns a new Client using c and starts reading responses.
+func NewClient(c *Conn) *Client {
+	client := &Client{
+		conn:    c,
+		pending: make(map[int]chan *Message),
+		done:    make(chan struct{}),
+	}
+	go client.read()
+	return client
+}
+
+// Call sends payload as a request on the given channel with an ID which
+// is unique among the pending calls, and waits for the response carrying
+// the same ID.
+//
+// If ctx is done before the response arrives, Call returns ctx.Err().
+// If it is done while the request is being written, the connection is
+// closed as well, since the request may have been partially written.
+// If the connection fails, every pending call returns the error.
+func (c *Client) Call(ctx context.Context, ch rune, payload []byte) (*Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	id, res, err := c.register()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := c.conn.SendContext(ctx, NewMessage(id, ch, payload)); err != nil {
+		c.unregister(id)
+		if ctx.Err() != nil {
+			c.conn.Close()
+		}
+		return nil, err
+	}
+
+	select {
+	case m := <-res:
+		return m, nil
+	case <-ctx.Done():
+		c.unregister(id)
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, c.err
+	}
+}
+
+// Close closes the underlying connection. Pending calls return
+// ErrClientClosed.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return ErrClientClosed
+	}
+	c.closing = true
+	c.mu.Unlock()
+	return c.conn.Close()
+}
+
+func (c *Client) register() (int, chan *Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing {
+		return 0, nil, ErrClientClosed
+	}
+	if c.err != nil {
+		return 0, nil, c.err
+	}
+
+	for {
+		id := c.nextID
+		// The largest ID is reserved for control messages.
+		if uint64(c.nextID) >= controlID-1 {
+			c.nextID = 0
+		} else {
+			c.nextID++
+		}
+		if _, ok := c.pending[id]; !ok {
+			res := make(chan *Message, 1)
+			c.pending[id] = res
+			return id, res, nil
+		}
+	}
+}
+
+func (c *Client) unregister(id int) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+func (c *Client) read() {
+	for {
+		m, err := c.conn.ReadMessage()
+		if err != nil {
+			c.mu.Lock()
+			if c.closing {
+				err = ErrClientClosed
+			}
+			c.err = err
+			c.pending = nil
+			c.mu.Unlock()
+			close(c.done)
+			return
+		}
+
+		c.mu.Lock()
+		res, ok := c.pending[m.ID]
+		delete(c.pending, m.ID)
+		c.mu.Unlock()
+
+		if ok {
+			res <- m
+		}
+	}
+}
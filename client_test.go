@@ -0,0 +1,109 @@
+package binproto_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/onur1/binproto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientCall(t *testing.T) {
+	a, b := net.Pipe()
+	client := binproto.NewClient(binproto.NewConn(a))
+	defer client.Close()
+
+	// Reply to every pair of requests in reverse order.
+	go func() {
+		server := binproto.NewConn(b)
+		for {
+			m1, err := server.ReadMessage()
+			if err != nil {
+				return
+			}
+			m2, err := server.ReadMessage()
+			if err != nil {
+				return
+			}
+			server.Send(binproto.NewMessage(m2.ID, m2.Channel, append([]byte("re:"), m2.Data...)))
+			server.Send(binproto.NewMessage(m1.ID, m1.Channel, append([]byte("re:"), m1.Data...)))
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payload := []byte(fill(i % 4))
+			m, err := client.Call(context.Background(), rune(i%16), payload)
+			assert.Nil(t, err)
+			assert.Equal(t, rune(i%16), m.Channel)
+			assert.Equal(t, "re:"+string(payload), string(m.Data))
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestClientCallCanceled(t *testing.T) {
+	a, b := net.Pipe()
+	client := binproto.NewClient(binproto.NewConn(a))
+	defer client.Close()
+
+	go func() {
+		server := binproto.NewConn(b)
+		for {
+			if _, err := server.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := client.Call(ctx, 1, nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestClientCallSendBlocked(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	client := binproto.NewClient(binproto.NewConn(a))
+	defer client.Close()
+
+	// Nobody is reading the other end.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := client.Call(ctx, 1, nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// The connection is closed, as the request was cut short.
+	_, err = client.Call(context.Background(), 1, nil)
+	assert.Error(t, err)
+}
+
+func TestClientConnectionFailure(t *testing.T) {
+	a, b := net.Pipe()
+	client := binproto.NewClient(binproto.NewConn(a))
+
+	go func() {
+		server := binproto.NewConn(b)
+		server.ReadMessage()
+		server.Close()
+	}()
+
+	_, err := client.Call(context.Background(), 1, nil)
+	assert.NotNil(t, err)
+
+	_, err = client.Call(context.Background(), 1, nil)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, client.Close())
+	_, err = client.Call(context.Background(), 1, nil)
+	assert.Equal(t, binproto.ErrClientClosed, err)
+}
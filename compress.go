@@ -0,0 +1,196 @@
+package binproto
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Compression identifies the codec a payload is compressed with. When
+// compression is enabled, every payload starts with a byte holding the
+// Compression it was compressed with, which is CompressionNone for
+// payloads sent as-is.
+type Compression byte
+
+const (
+	CompressionNone Compression = iota
+	CompressionFlate
+	CompressionGzip
+	CompressionZlib
+)
+
+const defaultCompressionThreshold = 1024
+
+var ErrUnknownCompression = errors.New("binproto: unknown compression")
+
+// A Compressor compresses and decompresses payloads.
+// It must be safe for concurrent use.
+type Compressor interface {
+	// Compress appends the compressed form of src to dst.
+	Compress(dst, src []byte) ([]byte, error)
+
+	// Decompress appends the decompressed form of src to dst. It returns
+	// ErrMessageSizeExceeded if that is larger than limit bytes.
+	Decompress(dst, src []byte, limit int) ([]byte, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[Compression]Compressor{
+		CompressionFlate: &stdCompressor{
+			newWriter: func(w io.Writer) resetWriter {
+				zw, _ := flate.NewWriter(w, flate.DefaultCompression)
+				return zw
+			},
+			newReader: func(r io.Reader) (io.Reader, error) {
+				return flate.NewReader(r), nil
+			},
+			resetReader: func(zr, r io.Reader) error {
+				return zr.(flate.Resetter).Reset(r, nil)
+			},
+		},
+		CompressionGzip: &stdCompressor{
+			newWriter: func(w io.Writer) resetWriter {
+				return gzip.NewWriter(w)
+			},
+			newReader: func(r io.Reader) (io.Reader, error) {
+				return gzip.NewReader(r)
+			},
+			resetReader: func(zr, r io.Reader) error {
+				return zr.(*gzip.Reader).Reset(r)
+			},
+		},
+		CompressionZlib: &stdCompressor{
+			newWriter: func(w io.Writer) resetWriter {
+				return zlib.NewWriter(w)
+			},
+			newReader: func(r io.Reader) (io.Reader, error) {
+				return zlib.NewReader(r)
+			},
+			resetReader: func(zr, r io.Reader) error {
+				return zr.(zlib.Resetter).Reset(r, nil)
+			},
+		},
+	}
+)
+
+// RegisterCompressor makes a Compressor available under the given
+// Compression. It panics if c is CompressionNone or already registered.
+func RegisterCompressor(c Compression, comp Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+
+	if c == CompressionNone || comp == nil {
+		panic("binproto: invalid compressor registration")
+	}
+	if _, dup := compressors[c]; dup {
+		panic(fmt.Sprintf("binproto: compressor %d registered twice", c))
+	}
+	compressors[c] = comp
+}
+
+func compressor(c Compression) Compressor {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	return compressors[c]
+}
+
+type resetWriter interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+// stdCompressor adapts the streaming codecs of the standard library,
+// reusing their state between payloads.
+type stdCompressor struct {
+	newWriter   func(io.Writer) resetWriter
+	newReader   func(io.Reader) (io.Reader, error)
+	resetReader func(zr, r io.Reader) error
+
+	writers, readers sync.Pool
+}
+
+type appendWriter struct {
+	b []byte
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
+
+func (c *stdCompressor) Compress(dst, src []byte) ([]byte, error) {
+	aw := &appendWriter{b: dst}
+	zw, _ := c.writers.Get().(resetWriter)
+	if zw == nil {
+		zw = c.newWriter(aw)
+	} else {
+		zw.Reset(aw)
+	}
+
+	_, err := zw.Write(src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+
+	zw.Reset(nil)
+	c.writers.Put(zw)
+
+	return aw.b, err
+}
+
+func (c *stdCompressor) Decompress(dst, src []byte, limit int) ([]byte, error) {
+	br := bytes.NewReader(src)
+	zr, _ := c.readers.Get().(io.Reader)
+	if zr == nil {
+		var err error
+		if zr, err = c.newReader(br); err != nil {
+			return dst, err
+		}
+	} else if err := c.resetReader(zr, br); err != nil {
+		return dst, err
+	}
+
+	buf := bytes.NewBuffer(dst)
+	_, err := buf.ReadFrom(io.LimitReader(zr, int64(limit)+1))
+	if err == nil && buf.Len()-len(dst) > limit {
+		err = ErrMessageSizeExceeded
+	}
+
+	c.readers.Put(zr)
+
+	return buf.Bytes(), err
+}
+
+// decompress returns the payload of data, which starts with
+// the Compression it was compressed with.
+func decompress(data []byte, limit int) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, ErrMessageMalformed
+	}
+	c := Compression(data[0])
+	if c == CompressionNone {
+		return data[1:], nil
+	}
+	comp := compressor(c)
+	if comp == nil {
+		return nil, ErrUnknownCompression
+	}
+	out, err := comp.Decompress(nil, data[1:], limit)
+	if err != nil {
+		if !errors.Is(err, ErrMessageSizeExceeded) {
+			err = fmt.Errorf("%w: %v", ErrMessageMalformed, err)
+		}
+		return nil, err
+	}
+	// Registered compressors may not honor the limit.
+	if len(out) > limit {
+		return nil, ErrMessageSizeExceeded
+	}
+	return out, nil
+}
@@ -0,0 +1,227 @@
+package binproto_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/onur1/binproto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompression(t *testing.T) {
+	large := binproto.NewMessage(42, 3, []byte(strings.Repeat("binproto ", 1000)))
+	small := newMessage(7, 1, 100)
+
+	for _, c := range []binproto.Compression{
+		binproto.CompressionNone,
+		binproto.CompressionFlate,
+		binproto.CompressionGzip,
+		binproto.CompressionZlib,
+	} {
+		var buf bytes.Buffer
+		w := binproto.NewWriterOptions(&buf, &binproto.WriterOptions{
+			Compressed:  true,
+			Compression: c,
+		})
+		assert.Nil(t, w.WriteMessage(large, small, large))
+
+		if c != binproto.CompressionNone {
+			assert.Less(t, buf.Len(), len(large.Data))
+		}
+
+		r := binproto.NewReaderOptions(&buf, &binproto.ReaderOptions{Compressed: true})
+		for _, expected := range []*binproto.Message{large, small, large} {
+			m, err := r.ReadMessage()
+			assert.Nil(t, err)
+			assert.EqualValues(t, expected, m)
+		}
+		_, err := r.ReadMessage()
+		assert.Equal(t, io.EOF, err)
+	}
+}
+
+func TestCompressionStreams(t *testing.T) {
+	large := binproto.NewMessage(42, 3, []byte(strings.Repeat("binproto ", 1000)))
+
+	var buf bytes.Buffer
+	w := binproto.NewWriterOptions(&buf, &binproto.WriterOptions{
+		Compressed:  true,
+		Compression: binproto.CompressionGzip,
+	})
+	assert.Nil(t, w.WriteMessage(large))
+	assert.Nil(t, w.WriteMessageFrom(7, 1, len(large.Data), bytes.NewReader(large.Data)))
+
+	r := binproto.NewReaderOptions(&buf, &binproto.ReaderOptions{Compressed: true})
+	for i := 0; i < 2; i++ {
+		m, body, err := r.NextMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, []int{42, 7}[i], m.ID)
+		data, err := io.ReadAll(body)
+		assert.Nil(t, err)
+		assert.Equal(t, large.Data, data)
+	}
+}
+
+func TestCompressionLimit(t *testing.T) {
+	bomb := binproto.NewMessage(42, 3, make([]byte, 1e6))
+
+	var buf bytes.Buffer
+	w := binproto.NewWriterOptions(&buf, &binproto.WriterOptions{
+		Compressed:  true,
+		Compression: binproto.CompressionFlate,
+	})
+	assert.Nil(t, w.WriteMessage(bomb, small()))
+	assert.Less(t, buf.Len(), 10000)
+
+	r := binproto.NewReaderOptions(&buf, &binproto.ReaderOptions{
+		Compressed:          true,
+		MaxDecompressedSize: 1e5,
+	})
+	_, err := r.ReadMessage()
+	var merr *binproto.MessageError
+	assert.True(t, errors.As(err, &merr))
+	assert.Equal(t, 42, merr.ID)
+	assert.Equal(t, binproto.ErrMessageSizeExceeded, merr.Err)
+
+	m, err := r.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, small(), m)
+}
+
+func TestCompressionMaxMessageSize(t *testing.T) {
+	var buf bytes.Buffer
+	w := binproto.NewWriterOptions(&buf, &binproto.WriterOptions{
+		Compressed:           true,
+		Compression:          binproto.CompressionFlate,
+		CompressionThreshold: 1e4,
+	})
+	assert.Nil(t, w.WriteMessage(newMessage(1, 0, 1024), newMessage(2, 0, 1025)))
+
+	r := binproto.NewReaderOptions(&buf, &binproto.ReaderOptions{Compressed: true, MaxMessageSize: 1024})
+	m, err := r.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(1, 0, 1024), m)
+	_, err = r.ReadMessage()
+	assert.Equal(t, binproto.ErrMessageSizeExceeded, err)
+}
+
+func TestCompressionNextMessageLimit(t *testing.T) {
+	// A length varint of 2^63-1, followed by a header and the flag
+	// of a compressed payload.
+	data := append(bytes.Repeat([]byte{0xff}, 8), 0x7f, 0x10, byte(binproto.CompressionFlate))
+	r := binproto.NewReaderOptions(bytes.NewReader(data), &binproto.ReaderOptions{Compressed: true})
+	_, _, err := r.NextMessage()
+	assert.ErrorIs(t, err, binproto.ErrMessageSizeExceeded)
+
+	var buf bytes.Buffer
+	w := binproto.NewWriterOptions(&buf, &binproto.WriterOptions{
+		Compressed:  true,
+		Compression: binproto.CompressionFlate,
+	})
+	assert.Nil(t, w.WriteMessage(binproto.NewMessage(42, 3, make([]byte, 1e6))))
+	r = binproto.NewReaderOptions(&buf, &binproto.ReaderOptions{
+		Compressed:          true,
+		MaxDecompressedSize: 1e5,
+	})
+	_, _, err = r.NextMessage()
+	assert.ErrorIs(t, err, binproto.ErrMessageSizeExceeded)
+}
+
+func small() *binproto.Message {
+	return newMessage(7, 1, 2)
+}
+
+// reverseCompressor reverses payloads ending with a zero byte,
+// which it drops.
+type reverseCompressor struct{}
+
+func (reverseCompressor) Compress(dst, src []byte) ([]byte, error) {
+	for i := len(src) - 2; i >= 0; i-- {
+		dst = append(dst, src[i])
+	}
+	return dst, nil
+}
+
+func (reverseCompressor) Decompress(dst, src []byte, limit int) ([]byte, error) {
+	for i := len(src) - 1; i >= 0; i-- {
+		dst = append(dst, src[i])
+	}
+	return append(dst, 0), nil
+}
+
+var registerReverse sync.Once
+
+func TestRegisterCompressor(t *testing.T) {
+	const reverse binproto.Compression = 200
+	registerReverse.Do(func() { binproto.RegisterCompressor(reverse, reverseCompressor{}) })
+	assert.Panics(t, func() { binproto.RegisterCompressor(reverse, reverseCompressor{}) })
+	assert.Panics(t, func() { binproto.RegisterCompressor(binproto.CompressionNone, reverseCompressor{}) })
+
+	m := binproto.NewMessage(42, 3, append([]byte(fill(2000)), 0))
+
+	var buf bytes.Buffer
+	w := binproto.NewWriterOptions(&buf, &binproto.WriterOptions{
+		Compressed:  true,
+		Compression: reverse,
+	})
+	assert.Nil(t, w.WriteMessage(m))
+
+	r := binproto.NewReaderOptions(&buf, &binproto.ReaderOptions{Compressed: true})
+	got, err := r.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, m, got)
+
+	// The limit holds even if the codec ignores it.
+	assert.Nil(t, w.WriteMessage(m))
+	r = binproto.NewReaderOptions(&buf, &binproto.ReaderOptions{
+		Compressed:          true,
+		MaxDecompressedSize: 1000,
+	})
+	_, err = r.ReadMessage()
+	assert.ErrorIs(t, err, binproto.ErrMessageSizeExceeded)
+
+	// Unknown codecs are rejected.
+	buf.Reset()
+	w = binproto.NewWriterOptions(&buf, &binproto.WriterOptions{
+		Compressed:  true,
+		Compression: 201,
+	})
+	err = w.WriteMessage(m)
+	var merr *binproto.MessageError
+	assert.True(t, errors.As(err, &merr))
+	assert.Equal(t, binproto.ErrUnknownCompression, merr.Err)
+}
+
+func TestConnCompression(t *testing.T) {
+	large := binproto.NewMessage(42, 3, []byte(strings.Repeat("binproto ", 1000)))
+
+	a, b := net.Pipe()
+	c := binproto.NewConnConfig(a, &binproto.ConnConfig{
+		Handshake:   true,
+		Compression: binproto.CompressionZlib,
+	})
+	defer c.Close()
+	d := binproto.NewConnConfig(b, &binproto.ConnConfig{
+		Handshake:    true,
+		Capabilities: binproto.CapCompression,
+	})
+	defer d.Close()
+
+	go c.Send(large)
+	m, err := d.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, large, m)
+
+	n, _ := d.Negotiated()
+	assert.Equal(t, binproto.CapCompression, n.Capabilities)
+
+	go d.Send(large)
+	m, err = c.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, large, m)
+}
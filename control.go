@@ -0,0 +1,48 @@
+package binproto
+
+// Messages with the largest ID are control messages which are handled
+// by the Conn itself, when a feature using them is enabled. Their
+// channel is the kind of the control message.
+const controlID = maxID
+
+const (
+	controlPing rune = iota
+	controlPong
+	controlHello
+	controlAck
+	controlResume
+)
+
+// reserveControlID rejects the messages using the ID of control
+// messages, when they are enabled.
+func reserveControlID(messages []*Message) error {
+	for i, m := range messages {
+		if m.ID == controlID {
+			return &MessageError{Index: i, ID: m.ID, Channel: m.Channel, Err: ErrInvalidID}
+		}
+	}
+	return nil
+}
+
+// control reports whether control messages are handled by c.
+func (c *Conn) control() bool {
+	return c.ka != nil || c.config.Handshake
+}
+
+// handleControl handles a control message read by c, and reports
+// whether it did. Other kinds are returned to the reader, as they
+// belong to the layers above the Conn, such as a Session.
+func (c *Conn) handleControl(m *Message) bool {
+	switch m.Channel {
+	case controlPing:
+		c.Writer.WriteMessage(NewMessage(controlID, controlPong, m.Data))
+	case controlPong:
+		if c.ka != nil {
+			c.ka.pong(m.Data)
+		}
+	case controlHello:
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,187 @@
+package binproto
+
+// A Decoder decodes messages from bytes which are pushed into it,
+// without doing any I/O. It keeps the state of a partially received
+// message between calls, so the bytes of a stream can be fed in chunks
+// of any size, as they arrive.
+type Decoder struct {
+	state    int
+	factor   uint64
+	varint   uint64
+	header   uint64
+	length   int
+	consumed int
+	maxMsg   int
+	overhead int // framing bytes allowed on top of maxMsg
+	stream   bool
+	pool     bool
+	messages []*Message
+	latest   []byte
+	msg      *Message
+	err      error
+}
+
+// NewDecoder returns a new Decoder which rejects messages with payloads
+// larger than maxMessageSize. If maxMessageSize is zero, 8 MiB is used.
+func NewDecoder(maxMessageSize int) *Decoder {
+	if maxMessageSize <= 0 {
+		maxMessageSize = defaultMaxMessageSize
+	}
+	return &Decoder{factor: 1, maxMsg: maxMessageSize}
+}
+
+// Feed decodes p and returns the messages completed by it, which may
+// be none. The payloads of the returned messages are copies, p can be
+// reused once Feed returns.
+//
+// When p contains malformed data Feed returns an error, along with the
+// messages decoded before it, and the Decoder stays failed until Reset.
+// A header which does not fit in 64 bits, and so carries an ID of 2^60
+// or more, violates the protocol and is reported with ErrInvalidID.
+func (b *Decoder) Feed(p []byte) ([]*Message, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	offset := 0
+	for b.err == nil && (offset < len(p) || (b.state == 2 && b.length == 0)) {
+		if b.state == 2 {
+			offset = b.readMessage(p, offset)
+		} else {
+			offset = b.readVarint(p, offset)
+		}
+	}
+
+	messages := b.messages
+	b.messages = nil
+
+	return messages, b.err
+}
+
+// Reset discards any partially decoded message and clears the error.
+func (b *Decoder) Reset() {
+	*b = Decoder{factor: 1, maxMsg: b.maxMsg, overhead: b.overhead, pool: b.pool}
+}
+
+func (b *Decoder) next() bool {
+	switch b.state {
+	case 0:
+		b.state = 1
+		b.factor = 1
+		b.length = int(b.varint)
+		b.consumed = 0
+		b.varint = 0
+		if b.length == 0 {
+			b.state = 0
+		}
+
+		return true
+	case 1:
+		b.state = 2
+		b.factor = 1
+		b.header = b.varint
+		b.length -= b.consumed
+		b.consumed = 0
+		b.varint = 0
+		if b.header>>4 > uint64(maxInt) {
+			b.err = ErrInvalidID
+
+			return false
+		}
+		if b.length < 0 || (!b.stream && b.length-b.overhead > b.maxMsg) {
+			b.err = ErrMessageSizeExceeded
+
+			return false
+		}
+
+		return true
+	case 2:
+		b.state = 0
+		id, ch := int(b.header>>4), rune(b.header&0b1111)
+		if m := b.msg; m != nil {
+			m.ID, m.Channel = id, ch
+			b.messages = append(b.messages, m)
+			b.msg = nil
+		} else {
+			b.messages = append(b.messages, NewMessage(id, ch, b.latest))
+		}
+		b.latest = nil
+		b.length = 0
+
+		return b.err == nil
+	default:
+		return false
+	}
+}
+
+func (b *Decoder) readMessage(data []byte, offset int) int {
+	length := len(data)
+
+	free := length - offset
+	if free >= b.length {
+		if b.latest != nil {
+			copy(b.latest[len(b.latest)-b.length:], data[offset:])
+		} else {
+			b.alloc()
+			copy(b.latest, data[offset:offset+b.length])
+		}
+
+		offset += b.length
+
+		if b.next() {
+			return offset
+		}
+
+		return length
+	}
+
+	if b.latest == nil {
+		b.alloc()
+	}
+
+	copy(b.latest[len(b.latest)-b.length:], data[offset:])
+
+	b.length -= free
+
+	return length
+}
+
+// alloc allocates the payload of the current message.
+func (b *Decoder) alloc() {
+	if b.pool {
+		b.msg = getMessage(b.length)
+		b.latest = b.msg.Data
+	} else {
+		b.latest = make([]byte, b.length)
+	}
+}
+
+func (b *Decoder) readVarint(data []byte, offset int) int {
+	for ; offset < len(data); offset++ {
+		// The 10th byte of a 64-bit varint can only be 0 or 1.
+		if b.consumed == maxVarintLen-1 && data[offset] > 1 {
+			if b.state == 0 {
+				b.err = ErrMessageMalformed
+			} else {
+				b.err = ErrInvalidID
+			}
+			return len(data)
+		}
+
+		b.varint += uint64(data[offset]&127) * b.factor
+		b.consumed += 1
+
+		if data[offset] < 128 {
+			offset += 1
+
+			if b.next() {
+				return offset
+			}
+			return len(data)
+		}
+
+		b.factor *= 128
+	}
+
+	return len(data)
+}
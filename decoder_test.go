@@ -0,0 +1,78 @@
+package binproto_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/onur1/binproto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecoderFeed(t *testing.T) {
+	expected := []*binproto.Message{
+		newMessage(5, 10, 2),
+		newMessage(0, 0, 0),
+		newMessage(42, 3, 1e4),
+		newMessage(maxID, 15, 5),
+	}
+
+	var xs [][]byte
+	for _, m := range expected {
+		xs = append(xs, newBytes(m.ID, m.Channel, len(m.Data), 0, 0))
+	}
+	b := flattened(xs)
+
+	for _, chunks := range [][][]byte{
+		reading(b),
+		chunksOf(b, 1),
+		chunksOf(b, 7),
+		randomChunksOf(b, 1, 100),
+	} {
+		d := binproto.NewDecoder(0)
+		var res []*binproto.Message
+		for _, chunk := range chunks {
+			// The decoder must not retain the fed bytes.
+			p := append([]byte(nil), chunk...)
+			messages, err := d.Feed(p)
+			assert.Nil(t, err)
+			for i := range p {
+				p[i] = 0
+			}
+			res = append(res, messages...)
+		}
+		assert.EqualValues(t, expected, res)
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	d := binproto.NewDecoder(1024)
+	messages, err := d.Feed(append(newBytes(42, 3, 2, 0, 0), newBytes(42, 3, 1025, 0, 0)...))
+	assert.EqualValues(t, []*binproto.Message{newMessage(42, 3, 2)}, messages)
+	assert.Equal(t, binproto.ErrMessageSizeExceeded, err)
+
+	_, err = d.Feed(newBytes(42, 3, 2, 0, 0))
+	assert.Equal(t, binproto.ErrMessageSizeExceeded, err)
+
+	d.Reset()
+	messages, err = d.Feed(newBytes(42, 3, 2, 0, 0))
+	assert.Nil(t, err)
+	assert.EqualValues(t, []*binproto.Message{newMessage(42, 3, 2)}, messages)
+
+	_, err = d.Feed(bytes.Repeat([]byte{0xff}, 11))
+	assert.Equal(t, binproto.ErrMessageMalformed, err)
+}
+
+func TestDecoderInvalidID(t *testing.T) {
+	// A header of 2^64, which carries an ID of 2^60.
+	header := []byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x02}
+	b := append([]byte{byte(len(header))}, header...)
+
+	_, err := binproto.NewDecoder(0).Feed(b)
+	assert.Equal(t, binproto.ErrInvalidID, err)
+
+	_, err = binproto.NewReader(bytes.NewReader(b)).ReadMessage()
+	assert.Equal(t, binproto.ErrInvalidID, err)
+
+	_, _, err = binproto.DecodeMessage(b)
+	assert.Equal(t, binproto.ErrInvalidID, err)
+}
@@ -1,103 +1,54 @@
 package binproto_test
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
-	"time"
 
 	"github.com/onur1/binproto"
 )
 
 func ExampleDial() {
-	s := &server{}
-
-	time.AfterFunc(time.Millisecond*1, func() {
-		c, err := binproto.Dial("tcp", ":4242")
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		go func() {
-			for {
-				msg, err := c.ReadMessage()
-				if err != nil {
-					log.Fatal(err)
-					return
-				}
-
-				fmt.Printf("%d %d %s\n", msg.ID, msg.Channel, msg.Data)
-
-				s.close()
-			}
-		}()
-
-		_, err = c.Send(binproto.NewMessage(42, 3, []byte("hi")))
-		if err != nil {
-			log.Fatal(err)
-		}
-	})
-
-	if err := s.serve("tcp", ":4242"); err != nil {
+	l, err := net.Listen("tcp", ":4242")
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	// output:
-	// 42 3 hi
-	// 112 5 hey
-}
-
-type server struct {
-	listener net.Listener
-}
-
-func (s *server) handle(conn net.Conn) {
-	defer conn.Close()
-
-	c := binproto.NewConn(conn)
+	s := &binproto.Server{
+		Handler: binproto.HandlerFunc(func(c *binproto.Conn, msg *binproto.Message) error {
+			fmt.Printf("%d %d %s\n", msg.ID, msg.Channel, msg.Data)
 
-	for {
-		msg, err := c.ReadMessage()
-		if err != nil {
-			fmt.Printf("error: %v", err)
-			return
-		}
+			_, err := c.Send(binproto.NewMessage(112, 5, []byte("hey")))
+			return err
+		}),
+	}
 
-		fmt.Printf("%d %d %s\n", msg.ID, msg.Channel, msg.Data)
+	go s.Serve(l)
 
-		_, err = c.Send(binproto.NewMessage(112, 5, []byte("hey")))
-		if err != nil {
-			log.Fatal(err)
-		}
+	c, err := binproto.Dial("tcp", ":4242")
+	if err != nil {
+		log.Fatal(err)
 	}
-}
+	defer c.Close()
 
-func (s *server) serve(network, address string) error {
-	l, err := net.Listen(network, address)
+	_, err = c.Send(binproto.NewMessage(42, 3, []byte("hi")))
 	if err != nil {
-		return err
+		log.Fatal(err)
 	}
 
-	s.listener = l
-
-	for {
-		if s.listener == nil {
-			break
-		}
+	msg, err := c.ReadMessage()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		c, err := l.Accept()
-		if err != nil {
-			continue
-		}
+	fmt.Printf("%d %d %s\n", msg.ID, msg.Channel, msg.Data)
 
-		go s.handle(c)
+	if err := s.Shutdown(context.Background()); err != nil {
+		log.Fatal(err)
 	}
 
-	return nil
-}
-
-func (s *server) close() error {
-	err := s.listener.Close()
-	s.listener = nil
-	return err
+	// output:
+	// 42 3 hi
+	// 112 5 hey
 }
@@ -0,0 +1,234 @@
+package binproto
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Datagrams of the channels with forward error correction are sent in
+// groups, each followed by a parity datagram which is the XOR of the
+// datagrams of the group, prefixed with their 16-bit lengths. A peer
+// missing a single datagram of a group rebuilds it from the others
+// and the parity.
+const (
+	// maxFECGroup bounds the number of datagrams of a group.
+	maxFECGroup = 64
+	// maxFECGroups bounds the number of groups received at the same time.
+	maxFECGroups = 1024
+	// fecHeaderSize bounds the size added to a datagram of a group, and
+	// to the parity of a group over the largest of its datagrams.
+	fecHeaderSize = 1 + 2*binary.MaxVarintLen64 + 2
+)
+
+// FECStats holds forward error correction statistics of a UDPConn.
+type FECStats struct {
+	Recovered     int // datagrams rebuilt from parity
+	Unrecoverable int // groups which lost too many datagrams to rebuild them
+}
+
+// fecOutGroup is a group of datagrams being sent.
+type fecOutGroup struct {
+	id     uint64 // number of the group << 4 | channel
+	n      int
+	parity []byte
+	opened time.Time
+}
+
+// fecGroup is a group of datagrams being received.
+type fecGroup struct {
+	packets   [maxFECGroup][]byte
+	have      int
+	n         int // known with the parity
+	parity    []byte
+	created   time.Time
+	recovered bool
+}
+
+// protect adds the data packet p to the parity group of the channel
+// ch, and returns the datagrams to send for it, which are p wrapped in
+// the group, followed by the parity once the group is complete.
+func (c *UDPConn) protect(ch rune, p []byte) [][]byte {
+	g := c.fecOut[ch]
+	if g == nil {
+		g = &fecOutGroup{id: c.fecNext[ch]<<4 | uint64(ch), opened: time.Now()}
+		c.fecNext[ch]++
+		c.fecOut[ch] = g
+	}
+
+	w := make([]byte, 0, fecHeaderSize+len(p))
+	w = append(w, packetFEC)
+	w = appendUvarint(w, g.id)
+	w = appendUvarint(w, uint64(g.n))
+	w = append(w, p...)
+	g.parity = xorPacket(g.parity, p)
+	g.n++
+
+	if g.n < c.config.FEC[ch] {
+		return [][]byte{w}
+	}
+	c.fecOut[ch] = nil
+	return [][]byte{w, g.parityPacket()}
+}
+
+func (g *fecOutGroup) parityPacket() []byte {
+	p := make([]byte, 0, fecHeaderSize+len(g.parity))
+	p = append(p, packetParity)
+	p = appendUvarint(p, g.id)
+	p = appendUvarint(p, uint64(g.n))
+	return append(p, g.parity...)
+}
+
+// flushParity returns the parity of the groups which were opened
+// before the previous tick, so that the last datagrams of a burst are
+// protected too.
+func (c *UDPConn) flushParity(now time.Time) [][]byte {
+	var out [][]byte
+	for ch, g := range c.fecOut {
+		if g != nil && now.Sub(g.opened) >= udpTickInterval {
+			out = append(out, g.parityPacket())
+			c.fecOut[ch] = nil
+		}
+	}
+	return out
+}
+
+// xorPacket XORs p, prefixed with its length, into parity.
+func xorPacket(parity, p []byte) []byte {
+	for len(parity) < 2+len(p) {
+		parity = append(parity, 0)
+	}
+	parity[0] ^= byte(len(p) >> 8)
+	parity[1] ^= byte(len(p))
+	for i, b := range p {
+		parity[2+i] ^= b
+	}
+	return parity
+}
+
+// handleFEC processes a data packet of a parity group, and returns the
+// ack to send for it, if any.
+func (c *UDPConn) handleFEC(b []byte) []byte {
+	id, b, ok := readUvarint(b)
+	if !ok {
+		return nil
+	}
+	index, b, ok := readUvarint(b)
+	if !ok || index >= maxFECGroup || len(b) == 0 {
+		return nil
+	}
+
+	g := c.fecGroup(id)
+	if g != nil {
+		if g.packets[index] != nil {
+			// Arriving late, after it was rebuilt.
+			return nil
+		}
+		g.packets[index] = append([]byte(nil), b...)
+		g.have++
+	}
+	ack := c.handleInner(b)
+	if g != nil {
+		if p := c.recoverFEC(id, g); p != nil {
+			if a := c.handleInner(p); a != nil {
+				ack = a
+			}
+		}
+	}
+	return ack
+}
+
+// handleParity processes the parity of a group, and returns the ack
+// to send for the packet it rebuilt, if any.
+func (c *UDPConn) handleParity(b []byte) []byte {
+	id, b, ok := readUvarint(b)
+	if !ok {
+		return nil
+	}
+	n, b, ok := readUvarint(b)
+	if !ok || n == 0 || n > maxFECGroup || len(b) < 2 {
+		return nil
+	}
+
+	g := c.fecGroup(id)
+	if g == nil || g.parity != nil {
+		return nil
+	}
+	g.parity = append([]byte(nil), b...)
+	g.n = int(n)
+	if p := c.recoverFEC(id, g); p != nil {
+		return c.handleInner(p)
+	}
+	return nil
+}
+
+// handleInner processes a packet which was wrapped in a parity group.
+func (c *UDPConn) handleInner(p []byte) []byte {
+	if len(p) == 0 || p[0]&0x0f != packetData {
+		return nil
+	}
+	return c.handleData(Delivery(p[0]>>4), p[1:])
+}
+
+// fecGroup returns the group id being received, or nil if there are
+// too many groups.
+func (c *UDPConn) fecGroup(id uint64) *fecGroup {
+	g := c.fecIn[id]
+	if g == nil {
+		if len(c.fecIn) >= maxFECGroups {
+			return nil
+		}
+		g = &fecGroup{created: time.Now()}
+		c.fecIn[id] = g
+	}
+	return g
+}
+
+// recoverFEC returns the packet missing from g, once it can be rebuilt.
+// Groups received whole are dropped, while those with a rebuilt packet
+// are kept until they expire, to drop it if it arrives late.
+func (c *UDPConn) recoverFEC(id uint64, g *fecGroup) []byte {
+	if g.parity == nil || g.recovered {
+		return nil
+	}
+	if g.have >= g.n {
+		delete(c.fecIn, id)
+		return nil
+	}
+	if g.have < g.n-1 {
+		return nil
+	}
+
+	missing := -1
+	buf := append([]byte(nil), g.parity...)
+	for i, p := range g.packets[:g.n] {
+		if p == nil {
+			missing = i
+			continue
+		}
+		buf = xorPacket(buf, p)
+	}
+	g.recovered = true
+
+	size := int(buf[0])<<8 | int(buf[1])
+	if missing < 0 || size == 0 || 2+size > len(buf) {
+		return nil
+	}
+	p := buf[2 : 2+size]
+	g.packets[missing] = p
+	c.fecStats.Recovered++
+	return p
+}
+
+// expireFEC drops the groups received for longer than ReassemblyTimeout,
+// counting those which could not be rebuilt.
+func (c *UDPConn) expireFEC(now time.Time) {
+	for id, g := range c.fecIn {
+		if now.Sub(g.created) <= c.config.ReassemblyTimeout {
+			continue
+		}
+		if g.parity != nil && !g.recovered && g.have < g.n {
+			c.fecStats.Unrecoverable++
+		}
+		delete(c.fecIn, id)
+	}
+}
@@ -0,0 +1,172 @@
+package binproto
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ProtocolVersion is the version of the protocol announced in handshakes.
+const ProtocolVersion = 1
+
+var ErrHandshake = errors.New("binproto: handshake failed")
+
+// Capabilities is a set of optional protocol features.
+type Capabilities uint64
+
+const (
+	CapCompression Capabilities = 1 << iota // compressed payloads
+	CapChecksum                             // checksummed messages
+)
+
+// Negotiated holds the parameters agreed on in a handshake.
+type Negotiated struct {
+	// Version is the highest protocol version both peers support.
+	Version int
+
+	// MaxMessageSize is the maximum payload size the peer reads.
+	// Larger messages are rejected by WriteMessage.
+	MaxMessageSize int
+
+	// Capabilities are the capabilities offered by both peers.
+	Capabilities Capabilities
+}
+
+// Handshake runs the opening handshake of the Conn if it is enabled and
+// has not run yet. Both peers send a hello control message, with their
+// protocol version, their maximum message size and their capabilities,
+// before any other message.
+//
+// Most uses of this package need not call Handshake explicitly: the first
+// read or write of the Conn will automatically run it. If the handshake
+// fails, the connection is closed.
+func (c *Conn) Handshake(ctx context.Context) error {
+	if !c.config.Handshake || atomic.LoadUint32(&c.hsDone) == 1 {
+		return c.hsErr
+	}
+
+	c.hsMu.Lock()
+	defer c.hsMu.Unlock()
+
+	if c.hsDone == 0 {
+		c.hsErr = c.handshake(ctx)
+		atomic.StoreUint32(&c.hsDone, 1)
+	}
+	return c.hsErr
+}
+
+// Negotiated returns the parameters agreed on in the handshake, and
+// reports whether a handshake has completed successfully.
+func (c *Conn) Negotiated() (Negotiated, bool) {
+	if atomic.LoadUint32(&c.hsDone) == 0 || c.hsErr != nil {
+		return Negotiated{}, false
+	}
+	return c.negotiated, true
+}
+
+// handshakeDone reports whether the handshake is disabled or over.
+func (c *Conn) handshakeDone() bool {
+	return !c.config.Handshake || atomic.LoadUint32(&c.hsDone) == 1
+}
+
+// autoHandshake runs the handshake on the first read or write, bounded
+// by the timeouts of the Conn when ctx has no deadline.
+func (c *Conn) autoHandshake(ctx context.Context) error {
+	if c.handshakeDone() {
+		return c.hsErr
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		if timeout := c.config.IdleTimeout + c.config.ReadTimeout; timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+	}
+	return c.Handshake(ctx)
+}
+
+func (c *Conn) handshake(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	hello := appendUvarint(nil, ProtocolVersion)
+	hello = appendUvarint(hello, uint64(c.Reader.d.maxMsg))
+	hello = appendUvarint(hello, uint64(c.config.Capabilities))
+
+	stopRead, stopWrite := func(err error) error { return err }, func(err error) error { return err }
+	if d, ok := c.conn.(interface {
+		SetReadDeadline(time.Time) error
+		SetWriteDeadline(time.Time) error
+	}); ok {
+		stopRead = watchContext(ctx, d.SetReadDeadline)
+		stopWrite = watchContext(ctx, d.SetWriteDeadline)
+	}
+
+	// Write and read at the same time, as both peers send first.
+	werr := make(chan error, 1)
+	go func() {
+		werr <- stopWrite(c.Writer.WriteMessage(NewMessage(controlID, controlHello, hello)))
+	}()
+
+	var n Negotiated
+	m, err := c.Reader.ReadMessage()
+	if err = stopRead(err); err == nil {
+		n, err = c.negotiate(m)
+	}
+	if err != nil {
+		// The peer may not be reading.
+		c.Close()
+		<-werr
+		return err
+	}
+	if err = <-werr; err != nil {
+		c.Close()
+		return err
+	}
+
+	// The framing may only change once the hello is out.
+	c.negotiated = n
+	if n.Capabilities&CapCompression != 0 {
+		c.enableCompression()
+	}
+	if n.Capabilities&CapChecksum != 0 {
+		c.enableChecksum()
+	}
+	return nil
+}
+
+// negotiate agrees on the parameters announced in the hello of the peer.
+func (c *Conn) negotiate(m *Message) (Negotiated, error) {
+	if m.ID != controlID || m.Channel != controlHello {
+		return Negotiated{}, ErrHandshake
+	}
+
+	var v [3]uint64
+	data := m.Data
+	for i := range v {
+		x, n := binary.Uvarint(data)
+		if n <= 0 {
+			return Negotiated{}, ErrHandshake
+		}
+		v[i], data = x, data[n:]
+	}
+	version, maxSize, caps := v[0], v[1], Capabilities(v[2])
+	if version == 0 {
+		return Negotiated{}, ErrHandshake
+	}
+
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	if maxSize > uint64(maxInt) {
+		maxSize = uint64(maxInt)
+	}
+	return Negotiated{
+		Version:        int(version),
+		MaxMessageSize: int(maxSize),
+		Capabilities:   c.config.Capabilities & caps,
+	}, nil
+}
@@ -0,0 +1,142 @@
+package binproto_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/onur1/binproto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandshake(t *testing.T) {
+	a, b := net.Pipe()
+	c := binproto.NewConnConfig(a, &binproto.ConnConfig{
+		Handshake:    true,
+		Capabilities: binproto.CapCompression | binproto.CapChecksum,
+	})
+	defer c.Close()
+	d := binproto.NewConnConfig(b, &binproto.ConnConfig{
+		Handshake:      true,
+		Capabilities:   binproto.CapChecksum,
+		MaxMessageSize: 1024,
+	})
+	defer d.Close()
+
+	_, ok := c.Negotiated()
+	assert.False(t, ok)
+
+	// The handshake runs on the first read and write.
+	go c.Send(newMessage(42, 3, 2))
+	m, err := d.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(42, 3, 2), m)
+
+	assert.Nil(t, c.Handshake(context.Background()))
+	n, ok := c.Negotiated()
+	assert.True(t, ok)
+	assert.Equal(t, binproto.Negotiated{
+		Version:        binproto.ProtocolVersion,
+		MaxMessageSize: 1024,
+		Capabilities:   binproto.CapChecksum,
+	}, n)
+
+	n, ok = d.Negotiated()
+	assert.True(t, ok)
+	assert.Equal(t, binproto.CapChecksum, n.Capabilities)
+	assert.Equal(t, 8*1024*1024, n.MaxMessageSize)
+
+	// Messages larger than the peer accepts are rejected.
+	err = c.WriteMessage(newMessage(42, 3, 2), newMessage(42, 3, 1025))
+	var merr *binproto.MessageError
+	assert.True(t, errors.As(err, &merr))
+	assert.Equal(t, 1, merr.Index)
+	assert.Equal(t, binproto.ErrMessageSizeExceeded, merr.Err)
+}
+
+func TestHandshakeMaxMessageSize(t *testing.T) {
+	a, b := net.Pipe()
+	c := binproto.NewConnConfig(a, &binproto.ConnConfig{
+		Handshake:            true,
+		Capabilities:         binproto.CapCompression | binproto.CapChecksum,
+		CompressionThreshold: 1e4,
+	})
+	defer c.Close()
+	d := binproto.NewConnConfig(b, &binproto.ConnConfig{
+		Handshake:      true,
+		Capabilities:   binproto.CapCompression | binproto.CapChecksum,
+		MaxMessageSize: 1024,
+	})
+	defer d.Close()
+
+	// The framing does not count against the limit of the peer.
+	go c.Send(newMessage(42, 3, 1024))
+	m, err := d.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(42, 3, 1024), m)
+
+	err = c.WriteMessage(newMessage(42, 3, 1025))
+	assert.ErrorIs(t, err, binproto.ErrMessageSizeExceeded)
+}
+
+func TestHandshakeWriteMethods(t *testing.T) {
+	a, b := net.Pipe()
+	var wrote []int
+	c := binproto.NewConnConfig(a, &binproto.ConnConfig{
+		Handshake: true,
+		OnWrite:   func(m *binproto.Message) { wrote = append(wrote, m.ID) },
+	})
+	defer c.Close()
+	d := binproto.NewConnConfig(b, &binproto.ConnConfig{
+		Handshake:      true,
+		MaxMessageSize: 1024,
+	})
+	defer d.Close()
+
+	// The handshake runs before a streamed message.
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.WriteMessageFrom(1, 1, 100, strings.NewReader(fill(100)))
+	}()
+	m, err := d.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(1, 1, 100), m)
+	assert.Nil(t, <-errc)
+
+	go func() {
+		if err := c.Buffer(newMessage(2, 1, 10)); err != nil {
+			errc <- err
+			return
+		}
+		errc <- c.Flush()
+	}()
+	m, err = d.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(2, 1, 10), m)
+	assert.Nil(t, <-errc)
+	assert.Equal(t, []int{1, 2}, wrote)
+
+	// Messages larger than the peer accepts are rejected.
+	assert.ErrorIs(t, c.WriteMessageFrom(3, 1, 1025, strings.NewReader(fill(1025))), binproto.ErrMessageSizeExceeded)
+	assert.ErrorIs(t, c.Buffer(newMessage(3, 1, 1025)), binproto.ErrMessageSizeExceeded)
+}
+
+func TestHandshakeDisabledPeer(t *testing.T) {
+	a, b := net.Pipe()
+	c := binproto.NewConnConfig(a, &binproto.ConnConfig{Handshake: true})
+	d := binproto.NewConn(b)
+	defer d.Close()
+
+	go func() {
+		d.ReadMessage()
+		d.Send(newMessage(42, 3, 2))
+	}()
+
+	assert.Equal(t, binproto.ErrHandshake, c.Handshake(context.Background()))
+	_, err := c.ReadMessage()
+	assert.Equal(t, binproto.ErrHandshake, err)
+	_, ok := c.Negotiated()
+	assert.False(t, ok)
+}
@@ -0,0 +1,164 @@
+package binproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+const defaultKeepAliveMissed = 3
+
+// ErrPeerTimeout is returned by reads on a Conn which was closed because
+// its peer did not reply to keepalive pings.
+var ErrPeerTimeout = errors.New("binproto: peer timed out")
+
+// RTTStats holds round-trip time statistics of a connection, measured
+// with keepalive pings on a Conn, and with acks on a UDPConn. The
+// smoothed RTT and its variance are computed as described in RFC 6298.
+type RTTStats struct {
+	Last     time.Duration // latest sample
+	Min      time.Duration // smallest sample
+	Smoothed time.Duration // smoothed RTT
+	Variance time.Duration // RTT variation
+	Samples  int           // number of samples
+}
+
+type keepalive struct {
+	c         *Conn
+	interval  time.Duration
+	maxMissed int
+	start     time.Time
+	done      chan struct{}
+	once      sync.Once
+
+	mu      sync.Mutex
+	missed  int
+	writing bool
+	err     error
+	rtt     RTTStats
+}
+
+func newKeepalive(c *Conn, interval time.Duration, maxMissed int) *keepalive {
+	if maxMissed <= 0 {
+		maxMissed = defaultKeepAliveMissed
+	}
+	return &keepalive{
+		c:         c,
+		interval:  interval,
+		maxMissed: maxMissed,
+		start:     time.Now(),
+		done:      make(chan struct{}),
+	}
+}
+
+func (k *keepalive) run() {
+	t := time.NewTicker(k.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-t.C:
+		}
+
+		// Nothing may be sent before the hello of the handshake.
+		if !k.c.handshakeDone() {
+			continue
+		}
+
+		k.mu.Lock()
+		if k.missed >= k.maxMissed {
+			k.err = ErrPeerTimeout
+			k.mu.Unlock()
+			k.c.Close()
+			return
+		}
+		k.missed++
+		// A ping blocked on a dead connection must not stop
+		// counting missed replies.
+		ping := !k.writing
+		k.writing = true
+		k.mu.Unlock()
+
+		if ping {
+			go k.ping()
+		}
+	}
+}
+
+// ping sends a ping carrying the time it was sent at.
+func (k *keepalive) ping() {
+	data := appendUvarint(nil, uint64(time.Since(k.start)))
+	k.c.Writer.WriteMessage(NewMessage(controlID, controlPing, data))
+
+	k.mu.Lock()
+	k.writing = false
+	k.mu.Unlock()
+}
+
+// pong records the reply to a ping.
+func (k *keepalive) pong(data []byte) {
+	sent, n := binary.Uvarint(data)
+	if n <= 0 {
+		return
+	}
+	r := time.Since(k.start) - time.Duration(sent)
+	if r < 0 {
+		return
+	}
+
+	k.mu.Lock()
+	k.rtt.add(r)
+	k.mu.Unlock()
+}
+
+// add records the sample r.
+func (s *RTTStats) add(r time.Duration) {
+	if s.Samples == 0 {
+		s.Smoothed = r
+		s.Variance = r / 2
+		s.Min = r
+	} else {
+		d := s.Smoothed - r
+		if d < 0 {
+			d = -d
+		}
+		s.Variance = (3*s.Variance + d) / 4
+		s.Smoothed = (7*s.Smoothed + r) / 8
+		if r < s.Min {
+			s.Min = r
+		}
+	}
+	s.Last = r
+	s.Samples++
+}
+
+// received records that the peer is alive.
+func (k *keepalive) received() {
+	k.mu.Lock()
+	k.missed = 0
+	k.mu.Unlock()
+}
+
+func (k *keepalive) stop() {
+	k.once.Do(func() { close(k.done) })
+}
+
+func (k *keepalive) error() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.err
+}
+
+// RTT returns the round-trip time statistics of the Conn, which are
+// only measured when keepalive is enabled.
+func (c *Conn) RTT() RTTStats {
+	if c.ka == nil {
+		return RTTStats{}
+	}
+	c.ka.mu.Lock()
+	defer c.ka.mu.Unlock()
+	return c.ka.rtt
+}
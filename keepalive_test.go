@@ -0,0 +1,161 @@
+package binproto_test
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/onur1/binproto"
+	"github.com/stretchr/testify/assert"
+)
+
+// tcpPipe returns both ends of a loopback TCP connection, which unlike
+// net.Pipe does not block writes until the other end reads.
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	a, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+func TestKeepAlive(t *testing.T) {
+	config := &binproto.ConnConfig{KeepAlive: 5 * time.Millisecond}
+
+	a, b := tcpPipe(t)
+	c, d := binproto.NewConnConfig(a, config), binproto.NewConnConfig(b, config)
+	defer c.Close()
+
+	go func() {
+		for {
+			m, err := d.ReadMessage()
+			if err != nil {
+				return
+			}
+			d.Send(m)
+		}
+	}()
+
+	// Pings are not returned by ReadMessage.
+	go c.Send(newMessage(42, 3, 2))
+	m, err := c.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(42, 3, 2), m)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.ReadMessage()
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	rtt := c.RTT()
+	assert.Greater(t, rtt.Samples, 0)
+	assert.Greater(t, int64(rtt.Smoothed), int64(0))
+	assert.LessOrEqual(t, int64(rtt.Min), int64(rtt.Last))
+
+	// The peer stops replying.
+	d.Close()
+	assert.NotNil(t, <-done)
+}
+
+func TestKeepAlivePeerTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	// The peer reads but never replies.
+	go io.Copy(io.Discard, b)
+
+	c := binproto.NewConnConfig(a, &binproto.ConnConfig{
+		KeepAlive:       5 * time.Millisecond,
+		KeepAliveMissed: 2,
+	})
+
+	start := time.Now()
+	_, err := c.ReadMessage()
+	assert.Equal(t, binproto.ErrPeerTimeout, err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.Equal(t, binproto.RTTStats{}, c.RTT())
+}
+
+func TestKeepAliveNextMessage(t *testing.T) {
+	const controlID = 1<<60 - 1
+
+	config := &binproto.ConnConfig{KeepAlive: 5 * time.Millisecond, KeepAliveMissed: 2}
+
+	a, b := tcpPipe(t)
+	c, d := binproto.NewConnConfig(a, config), binproto.NewConnConfig(b, config)
+	defer c.Close()
+
+	go func() {
+		for {
+			m, body, err := d.NextMessage()
+			if err != nil {
+				return
+			}
+			if m.ID == controlID {
+				t.Errorf("control message on channel %d", m.Channel)
+			}
+			m.Data, _ = io.ReadAll(body)
+			d.Send(m)
+		}
+	}()
+
+	// Pings are answered, and not returned by NextMessage.
+	go c.Send(newMessage(42, 3, 2))
+	m, body, err := c.NextMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, 42, m.ID)
+	data, _ := io.ReadAll(body)
+	assert.Equal(t, fill(2), string(data))
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := c.NextMessage()
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Greater(t, c.RTT().Samples, 0)
+	select {
+	case err := <-done:
+		t.Fatalf("alive peer: %v", err)
+	default:
+	}
+
+	// The peer stops replying.
+	d.Close()
+	assert.NotNil(t, <-done)
+}
+
+func TestKeepAliveReservedID(t *testing.T) {
+	const controlID = 1<<60 - 1
+
+	a, b := tcpPipe(t)
+	c := binproto.NewConnConfig(a, &binproto.ConnConfig{KeepAlive: time.Hour})
+	defer c.Close()
+	d := binproto.NewConn(b)
+	defer d.Close()
+
+	err := c.WriteMessage(newMessage(42, 3, 2), newMessage(controlID, 0, 2))
+	var merr *binproto.MessageError
+	assert.ErrorAs(t, err, &merr)
+	assert.Equal(t, 1, merr.Index)
+	assert.Equal(t, binproto.ErrInvalidID, merr.Err)
+	assert.ErrorIs(t, c.Buffer(newMessage(controlID, 0, 2)), binproto.ErrInvalidID)
+	assert.ErrorIs(t, c.WriteMessageFrom(controlID, 0, 2, strings.NewReader("ab")), binproto.ErrInvalidID)
+
+	// Without control messages, the ID is available.
+	assert.Nil(t, d.WriteMessage(newMessage(controlID, 0, 2)))
+}
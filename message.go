@@ -1,14 +1,44 @@
 package binproto
 
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// maxID is the largest ID which fits in the 60 bits of a header.
+	maxID = 1<<60 - 1
+	// maxChannel is the largest channel which fits in the 4 bits of a header.
+	maxChannel = 15
+	maxInt     = int(^uint(0) >> 1)
+)
+
+var (
+	ErrInvalidID      = errors.New("binproto: invalid message ID")
+	ErrInvalidChannel = errors.New("binproto: invalid message channel")
+)
+
 // A Message represents a single binproto message.
 //
 // Each message starts with an header which is a varint encoded
 // unsigned 64-bit integer which consists of an ID (first 60-bits) and
 // a Channel number (last 4-bits), the rest of the message is payload.
+//
+// Valid IDs are in the range [0, 2^60) and valid channels are in the
+// range [0, 15]. Writing a message out of these ranges fails with
+// ErrInvalidID or ErrInvalidChannel.
+//
+// The largest ID, 2^60-1, is reserved for control messages on a Conn
+// with keepalive or the handshake enabled, and on a Session. Writing
+// a message with it there fails with ErrInvalidID.
 type Message struct {
 	ID      int
 	Channel rune
 	Data    []byte
+
+	class int8 // pool size class + 1, zero if not pooled
 }
 
 // NewMessage returns a new Message.
@@ -19,3 +49,125 @@ func NewMessage(id int, ch rune, data []byte) *Message {
 		Data:    data,
 	}
 }
+
+// EncodedSize returns the number of bytes the encoding of m takes.
+func (m *Message) EncodedSize() int {
+	header := m.header()
+	length := len(m.Data) + encodingLength(header)
+	return encodingLength(uint64(length)) + length
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface.
+func (m *Message) MarshalBinary() ([]byte, error) {
+	return AppendMessage(make([]byte, 0, m.EncodedSize()), m)
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface.
+// The data must hold exactly one message.
+func (m *Message) UnmarshalBinary(data []byte) error {
+	res, n, err := DecodeMessage(data)
+	if err != nil {
+		return err
+	}
+	if n != len(data) {
+		return ErrMessageMalformed
+	}
+	*m = *res
+	return nil
+}
+
+// validate checks that the ID and the channel of m fit in a header.
+func (m *Message) validate() error {
+	return validate(m.ID, m.Channel)
+}
+
+func validate(id int, ch rune) error {
+	var err error
+	if id < 0 || uint64(id) > maxID {
+		err = ErrInvalidID
+	} else if ch < 0 || ch > maxChannel {
+		err = ErrInvalidChannel
+	}
+	if err != nil {
+		return &MessageError{ID: id, Channel: ch, Err: err}
+	}
+	return nil
+}
+
+func (m *Message) header() uint64 {
+	return uint64(m.ID)<<4 | uint64(m.Channel)
+}
+
+// AppendMessage appends the encoding of m to dst and returns the
+// extended buffer. If m is not valid, AppendMessage returns dst
+// unchanged and a *MessageError.
+func AppendMessage(dst []byte, m *Message) ([]byte, error) {
+	if err := m.validate(); err != nil {
+		return dst, err
+	}
+	return append(appendHeader(dst, m.header(), len(m.Data)), m.Data...), nil
+}
+
+// appendHeader appends the length and the header varints of a frame
+// with size bytes following the header to dst.
+func appendHeader(dst []byte, header uint64, size int) []byte {
+	dst = appendUvarint(dst, uint64(size+encodingLength(header)))
+	return appendUvarint(dst, header)
+}
+
+// DecodeMessage decodes the first message in buf and returns it along
+// with the number of bytes read. Data of the returned message is a copy.
+//
+// DecodeMessage returns io.ErrUnexpectedEOF if buf ends before the
+// message is complete, ErrInvalidID if the header does not fit in 64 bits
+// or its ID does not fit in an int, and ErrMessageMalformed if the
+// encoding is otherwise invalid.
+func DecodeMessage(buf []byte) (*Message, int, error) {
+	offset := 0
+
+	// Skip empty frames.
+	for offset < len(buf) && buf[offset] == 0 {
+		offset++
+	}
+
+	length, n := binary.Uvarint(buf[offset:])
+	if n == 0 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if n < 0 {
+		return nil, 0, ErrMessageMalformed
+	}
+	offset += n
+
+	if uint64(len(buf)-offset) < length {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	frame := buf[offset : offset+int(length)]
+
+	header, n := binary.Uvarint(frame)
+	if n == 0 {
+		return nil, 0, ErrMessageMalformed
+	}
+	if n < 0 || header>>4 > uint64(maxInt) {
+		return nil, 0, ErrInvalidID
+	}
+
+	data := make([]byte, len(frame)-n)
+	copy(data, frame[n:])
+
+	return NewMessage(int(header>>4), rune(header&0b1111), data), offset + len(frame), nil
+}
+
+// A MessageError records an error and the message that caused it.
+type MessageError struct {
+	Index   int // position of the message in a batch
+	ID      int
+	Channel rune
+	Err     error
+}
+
+func (e *MessageError) Error() string {
+	return fmt.Sprintf("%v (id %d, channel %d)", e.Err, e.ID, e.Channel)
+}
+
+func (e *MessageError) Unwrap() error { return e.Err }
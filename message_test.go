@@ -0,0 +1,71 @@
+package binproto_test
+
+import (
+	"encoding"
+	"io"
+	"testing"
+
+	"github.com/onur1/binproto"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	_ encoding.BinaryMarshaler   = (*binproto.Message)(nil)
+	_ encoding.BinaryUnmarshaler = (*binproto.Message)(nil)
+)
+
+func TestAppendMessage(t *testing.T) {
+	messages := []*binproto.Message{
+		newMessage(0, 0, 0),
+		newMessage(42, 3, 2),
+		newMessage(maxID, 15, 1e4),
+	}
+
+	var buf []byte
+	for _, m := range messages {
+		n := len(buf)
+		var err error
+		buf, err = binproto.AppendMessage(buf, m)
+		assert.Nil(t, err)
+		assert.Equal(t, newBytes(m.ID, m.Channel, len(m.Data), 0, 0), buf[n:])
+		assert.Equal(t, m.EncodedSize(), len(buf)-n)
+	}
+
+	for _, m := range messages {
+		res, n, err := binproto.DecodeMessage(buf)
+		assert.Nil(t, err)
+		assert.EqualValues(t, m, res)
+		buf = buf[n:]
+	}
+	assert.Empty(t, buf)
+}
+
+func TestDecodeMessage(t *testing.T) {
+	b := newBytes(42, 3, 2, 0, 0)
+
+	res, n, err := binproto.DecodeMessage(append([]byte{0, 0}, b...))
+	assert.Nil(t, err)
+	assert.Equal(t, len(b)+2, n)
+	assert.EqualValues(t, newMessage(42, 3, 2), res)
+
+	for i := 0; i < len(b); i++ {
+		_, _, err = binproto.DecodeMessage(b[:i])
+		assert.Equal(t, io.ErrUnexpectedEOF, err)
+	}
+
+	_, _, err = binproto.DecodeMessage([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+	assert.Equal(t, binproto.ErrMessageMalformed, err)
+}
+
+func TestMarshalBinary(t *testing.T) {
+	m := newMessage(maxID, 15, 5)
+	b, err := m.MarshalBinary()
+	assert.Nil(t, err)
+	assert.Equal(t, newBytes(maxID, 15, 5, 0, 0), b)
+
+	var res binproto.Message
+	assert.Nil(t, res.UnmarshalBinary(b))
+	assert.EqualValues(t, m, &res)
+
+	assert.Equal(t, binproto.ErrMessageMalformed, res.UnmarshalBinary(append(b, 0)))
+}
@@ -0,0 +1,268 @@
+package binproto
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+const (
+	numChannels  = 16
+	muxQueueSize = 64
+)
+
+var ErrUnknownChannel = errors.New("binproto: unknown channel")
+
+// ServeMux is a binproto message multiplexer. It matches the channel
+// and ID of each incoming message against a list of registered handlers
+// and calls the handler that matches.
+//
+// Messages on the same channel of a connection are handled one at a time,
+// in the order they were received, while messages on different channels
+// are handled concurrently. Handlers replying on the Conn should use
+// Send which is safe for concurrent use.
+type ServeMux struct {
+	mu       sync.RWMutex
+	channels [numChannels]muxChannel
+	conns    map[*Conn]*muxConn
+}
+
+type muxChannel struct {
+	h      Handler
+	ranges []muxRange
+}
+
+type muxRange struct {
+	lo, hi int
+	h      Handler
+}
+
+type muxConn struct {
+	c      *Conn
+	queues [numChannels]chan muxEntry
+	wg     sync.WaitGroup
+	done   chan struct{}
+	once   sync.Once
+	err    error
+}
+
+type muxEntry struct {
+	h Handler
+	m *Message
+}
+
+// NewServeMux allocates and returns a new ServeMux.
+func NewServeMux() *ServeMux {
+	return &ServeMux{conns: make(map[*Conn]*muxConn)}
+}
+
+// Handle registers the handler for all messages on the given channel
+// which are not matched by a handler registered with HandleRange.
+// If a handler already exists for the channel, Handle panics.
+func (mux *ServeMux) Handle(ch rune, handler Handler) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	mc := mux.channel(ch, handler)
+	if mc.h != nil {
+		panic(fmt.Sprintf("binproto: multiple registrations for channel %d", ch))
+	}
+	mc.h = handler
+}
+
+// HandleFunc registers the handler function for the given channel.
+func (mux *ServeMux) HandleFunc(ch rune, handler func(*Conn, *Message) error) {
+	if handler == nil {
+		panic("binproto: nil handler")
+	}
+	mux.Handle(ch, HandlerFunc(handler))
+}
+
+// HandleRange registers the handler for messages on the given channel
+// whose ID is in the inclusive range [lo, hi].
+// If the range overlaps with an already registered one, HandleRange panics.
+func (mux *ServeMux) HandleRange(ch rune, lo, hi int, handler Handler) {
+	if lo > hi {
+		panic("binproto: invalid ID range")
+	}
+
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	mc := mux.channel(ch, handler)
+	for _, r := range mc.ranges {
+		if lo <= r.hi && r.lo <= hi {
+			panic(fmt.Sprintf("binproto: overlapping registrations for channel %d", ch))
+		}
+	}
+	mc.ranges = append(mc.ranges, muxRange{lo: lo, hi: hi, h: handler})
+}
+
+// Handler returns the handler to use for the given message,
+// or nil if there is none.
+func (mux *ServeMux) Handler(m *Message) Handler {
+	if m.Channel < 0 || m.Channel >= numChannels {
+		return nil
+	}
+
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+
+	mc := &mux.channels[m.Channel]
+	for _, r := range mc.ranges {
+		if m.ID >= r.lo && m.ID <= r.hi {
+			return r.h
+		}
+	}
+	return mc.h
+}
+
+// ServeMessage dispatches the message to the handler registered for it.
+// It returns a *MessageError wrapping ErrUnknownChannel if there is
+// no such handler, and the error of a previously failed handler of the
+// same connection, in which case the connection has already been closed.
+func (mux *ServeMux) ServeMessage(c *Conn, m *Message) error {
+	h := mux.Handler(m)
+	if h == nil {
+		return &MessageError{ID: m.ID, Channel: m.Channel, Err: ErrUnknownChannel}
+	}
+
+	mc := mux.conn(c)
+
+	select {
+	case <-mc.done:
+		return mc.err
+	default:
+	}
+
+	select {
+	case mc.queue(m.Channel) <- muxEntry{h: h, m: m}:
+		return nil
+	case <-mc.done:
+		return mc.err
+	}
+}
+
+// ServeConn reads messages from c and dispatches them until an error
+// occurs, and then waits for the handlers in progress to return.
+// ServeConn returns the error of the first failed handler if there is
+// one, otherwise the error which stopped reading.
+func (mux *ServeMux) ServeConn(c *Conn) error {
+	var err error
+	for {
+		var m *Message
+		if m, err = c.ReadMessage(); err != nil {
+			break
+		}
+		if err = mux.ServeMessage(c, m); err != nil {
+			break
+		}
+	}
+	if ferr := mux.finishConn(c); ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// finishConn waits for the handlers in progress for c to return
+// and releases the resources allocated for it.
+func (mux *ServeMux) finishConn(c *Conn) error {
+	mux.mu.Lock()
+	mc, ok := mux.conns[c]
+	delete(mux.conns, c)
+	mux.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	for _, q := range mc.queues {
+		if q != nil {
+			close(q)
+		}
+	}
+	mc.wg.Wait()
+
+	select {
+	case <-mc.done:
+		return mc.err
+	default:
+		return nil
+	}
+}
+
+func (mux *ServeMux) channel(ch rune, handler Handler) *muxChannel {
+	if ch < 0 || ch >= numChannels {
+		panic(fmt.Sprintf("binproto: invalid channel %d", ch))
+	}
+	if handler == nil {
+		panic("binproto: nil handler")
+	}
+	return &mux.channels[ch]
+}
+
+func (mux *ServeMux) conn(c *Conn) *muxConn {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	if mux.conns == nil {
+		mux.conns = make(map[*Conn]*muxConn)
+	}
+	mc, ok := mux.conns[c]
+	if !ok {
+		mc = &muxConn{c: c, done: make(chan struct{})}
+		mux.conns[c] = mc
+	}
+	return mc
+}
+
+// queue returns the queue of the given channel, starting its worker
+// if necessary. It is only called from the goroutine reading c.
+func (mc *muxConn) queue(ch rune) chan muxEntry {
+	q := mc.queues[ch]
+	if q == nil {
+		q = make(chan muxEntry, muxQueueSize)
+		mc.queues[ch] = q
+		mc.wg.Add(1)
+		go mc.work(q)
+	}
+	return q
+}
+
+func (mc *muxConn) work(q chan muxEntry) {
+	defer mc.wg.Done()
+
+	for e := range q {
+		select {
+		case <-mc.done:
+			continue
+		default:
+		}
+		if err := serveMessage(e.h, mc.c, e.m); err != nil {
+			mc.fail(err)
+		}
+	}
+}
+
+func (mc *muxConn) fail(err error) {
+	mc.once.Do(func() {
+		mc.err = err
+		close(mc.done)
+		if mc.c != nil {
+			mc.c.Close()
+		}
+	})
+}
+
+func serveMessage(h Handler, c *Conn, m *Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			const size = 64 << 10
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+			err = fmt.Errorf("binproto: panic serving message %d on channel %d: %v\n%s", m.ID, m.Channel, r, buf)
+		}
+	}()
+	return h.ServeMessage(c, m)
+}
@@ -0,0 +1,115 @@
+package binproto_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/onur1/binproto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeMuxRouting(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got = make(map[string][]int)
+	)
+
+	record := func(name string) binproto.HandlerFunc {
+		return func(c *binproto.Conn, m *binproto.Message) error {
+			mu.Lock()
+			got[name] = append(got[name], m.ID)
+			mu.Unlock()
+			return nil
+		}
+	}
+
+	mux := binproto.NewServeMux()
+	mux.Handle(1, record("default"))
+	mux.HandleRange(1, 100, 199, record("range"))
+	mux.Handle(2, record("other"))
+
+	a, b := net.Pipe()
+	client, server := binproto.NewConn(a), binproto.NewConn(b)
+
+	go func() {
+		for i := 0; i < 300; i++ {
+			_, err := client.Send(newMessage(i, rune(1+i%2), 0))
+			assert.Nil(t, err)
+		}
+		client.Close()
+	}()
+
+	assert.Equal(t, io.EOF, mux.ServeConn(server))
+
+	var defaults, ranged, others []int
+	for i := 0; i < 300; i++ {
+		switch {
+		case i%2 == 1:
+			others = append(others, i)
+		case i >= 100 && i <= 199:
+			ranged = append(ranged, i)
+		default:
+			defaults = append(defaults, i)
+		}
+	}
+	assert.Equal(t, defaults, got["default"])
+	assert.Equal(t, ranged, got["range"])
+	assert.Equal(t, others, got["other"])
+}
+
+func TestServeMuxConcurrentChannels(t *testing.T) {
+	unblock := make(chan struct{})
+
+	mux := binproto.NewServeMux()
+	mux.HandleFunc(1, func(c *binproto.Conn, m *binproto.Message) error {
+		<-unblock
+		return nil
+	})
+	mux.HandleFunc(2, func(c *binproto.Conn, m *binproto.Message) error {
+		close(unblock)
+		return nil
+	})
+
+	a, b := net.Pipe()
+	client, server := binproto.NewConn(a), binproto.NewConn(b)
+
+	go func() {
+		client.Send(newMessage(0, 1, 0))
+		client.Send(newMessage(0, 2, 0))
+		client.Close()
+	}()
+
+	assert.Equal(t, io.EOF, mux.ServeConn(server))
+}
+
+func TestServeMuxErrors(t *testing.T) {
+	errBoom := errors.New("boom")
+
+	mux := binproto.NewServeMux()
+	mux.HandleFunc(1, func(c *binproto.Conn, m *binproto.Message) error {
+		return errBoom
+	})
+
+	err := mux.ServeMessage(nil, newMessage(42, 3, 0))
+	var merr *binproto.MessageError
+	assert.True(t, errors.As(err, &merr))
+	assert.Equal(t, 42, merr.ID)
+	assert.Equal(t, rune(3), merr.Channel)
+	assert.True(t, errors.Is(err, binproto.ErrUnknownChannel))
+
+	a, b := net.Pipe()
+	client, server := binproto.NewConn(a), binproto.NewConn(b)
+	defer client.Close()
+
+	go client.Send(newMessage(0, 1, 0))
+
+	assert.Equal(t, errBoom, mux.ServeConn(server))
+
+	assert.Panics(t, func() { mux.HandleRange(1, 0, 10, nil) })
+	mux.HandleRange(1, 0, 10, mux)
+	assert.Panics(t, func() { mux.HandleRange(1, 10, 20, mux) })
+	assert.Panics(t, func() { mux.Handle(16, mux) })
+}
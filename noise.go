@@ -0,0 +1,223 @@
+package binproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/flynn/noise"
+)
+
+const (
+	noiseMaxFrameSize = 65535
+	noiseMaxPlaintext = noiseMaxFrameSize - 16
+)
+
+var ErrNoiseHandshake = errors.New("binproto: noise handshake failed")
+
+// DefaultNoiseCipherSuite is the cipher suite used by NewNoiseConn
+// when the config does not specify one.
+var DefaultNoiseCipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2b)
+
+// NewNoiseConn runs a Noise handshake over conn and returns a new Conn
+// which encrypts everything it writes and decrypts everything it reads.
+//
+// The handshake pattern defaults to XX. IK initiators must set
+// config.PeerStatic to the static public key of the responder.
+// Every Noise transport message is prefixed with its length as a
+// 2-byte big-endian integer, including the handshake messages.
+//
+// The deadlines of conn are used for timeouts and contexts if it has
+// SetReadDeadline and SetWriteDeadline methods.
+func NewNoiseConn(conn io.ReadWriteCloser, config noise.Config) (*Conn, error) {
+	nc, err := newNoiseConn(conn, config)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := conn.(deadliner); ok {
+		return NewConn(&noiseDeadlineConn{nc}), nil
+	}
+	return NewConn(nc), nil
+}
+
+// DialNoise connects to the given address on the given network using
+// net.Dial, runs a Noise handshake as the initiator and then returns
+// a new Conn for the connection.
+func DialNoise(network, addr string, config noise.Config) (*Conn, error) {
+	c, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	config.Initiator = true
+	conn, err := NewNoiseConn(c, config)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// RemoteStatic returns the static public key of the remote peer,
+// or nil if the connection is not encrypted with Noise.
+func (c *Conn) RemoteStatic() []byte {
+	switch nc := c.conn.(type) {
+	case *noiseConn:
+		return nc.peerStatic
+	case *noiseDeadlineConn:
+		return nc.peerStatic
+	}
+	return nil
+}
+
+type deadliner interface {
+	SetReadDeadline(time.Time) error
+	SetWriteDeadline(time.Time) error
+}
+
+type noiseConn struct {
+	io.ReadWriteCloser
+	enc, dec   *noise.CipherState
+	peerStatic []byte
+	hdr        [2]byte
+	rframe     []byte
+	rn         int // bytes of the current frame read, including its header
+	rbuf       []byte
+	wbuf       []byte
+}
+
+// noiseDeadlineConn is a noiseConn over a connection with deadlines.
+type noiseDeadlineConn struct {
+	*noiseConn
+}
+
+func (c *noiseDeadlineConn) SetReadDeadline(t time.Time) error {
+	return c.ReadWriteCloser.(deadliner).SetReadDeadline(t)
+}
+
+func (c *noiseDeadlineConn) SetWriteDeadline(t time.Time) error {
+	return c.ReadWriteCloser.(deadliner).SetWriteDeadline(t)
+}
+
+func newNoiseConn(conn io.ReadWriteCloser, config noise.Config) (*noiseConn, error) {
+	if config.CipherSuite == nil {
+		config.CipherSuite = DefaultNoiseCipherSuite
+	}
+	if config.Pattern.Name == "" {
+		config.Pattern = noise.HandshakeXX
+	}
+
+	hs, err := noise.NewHandshakeState(config)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &noiseConn{
+		ReadWriteCloser: conn,
+		rframe:          make([]byte, noiseMaxFrameSize),
+	}
+
+	var cs1, cs2 *noise.CipherState
+
+	for i := 0; cs1 == nil; i++ {
+		if (i%2 == 0) == config.Initiator {
+			var msg []byte
+			msg, cs1, cs2, err = hs.WriteMessage(make([]byte, 2), nil)
+			if err != nil {
+				return nil, err
+			}
+			if err = c.writeFrame(msg); err != nil {
+				return nil, err
+			}
+		} else {
+			var msg []byte
+			if msg, err = c.readFrame(); err != nil {
+				return nil, err
+			}
+			if _, cs1, cs2, err = hs.ReadMessage(nil, msg); err != nil {
+				return nil, ErrNoiseHandshake
+			}
+		}
+	}
+
+	if config.Initiator {
+		c.enc, c.dec = cs1, cs2
+	} else {
+		c.enc, c.dec = cs2, cs1
+	}
+	c.peerStatic = hs.PeerStatic()
+
+	return c, nil
+}
+
+func (c *noiseConn) Read(p []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		frame, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		c.rbuf, err = c.dec.Decrypt(frame[:0], nil, frame)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *noiseConn) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > noiseMaxPlaintext {
+			chunk = chunk[:noiseMaxPlaintext]
+		}
+		c.wbuf, err = c.enc.Encrypt(append(c.wbuf[:0], 0, 0), nil, chunk)
+		if err != nil {
+			return n, err
+		}
+		if err = c.writeFrame(c.wbuf); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// readFrame reads the next frame. The bytes of a frame which were read
+// before an error, such as a timeout, are kept for the next call.
+func (c *noiseConn) readFrame() ([]byte, error) {
+	for c.rn < len(c.hdr) {
+		n, err := c.ReadWriteCloser.Read(c.hdr[c.rn:])
+		c.rn += n
+		if err != nil && c.rn < len(c.hdr) {
+			if errors.Is(err, io.EOF) && c.rn > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	frame := c.rframe[:binary.BigEndian.Uint16(c.hdr[:])]
+	for c.rn-len(c.hdr) < len(frame) {
+		n, err := c.ReadWriteCloser.Read(frame[c.rn-len(c.hdr):])
+		c.rn += n
+		if err != nil && c.rn-len(c.hdr) < len(frame) {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	c.rn = 0
+	return frame, nil
+}
+
+// writeFrame writes frame, whose first two bytes are reserved
+// for the length prefix.
+func (c *noiseConn) writeFrame(frame []byte) error {
+	binary.BigEndian.PutUint16(frame, uint16(len(frame)-2))
+	_, err := c.ReadWriteCloser.Write(frame)
+	return err
+}
@@ -0,0 +1,173 @@
+package binproto_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/onur1/binproto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNoiseConn(t *testing.T) {
+	clientKey, err := binproto.DefaultNoiseCipherSuite.GenerateKeypair(nil)
+	assert.Nil(t, err)
+	serverKey, err := binproto.DefaultNoiseCipherSuite.GenerateKeypair(nil)
+	assert.Nil(t, err)
+
+	testCases := []struct {
+		desc    string
+		pattern noise.HandshakePattern
+		peer    []byte
+	}{
+		{desc: "XX", pattern: noise.HandshakeXX},
+		{desc: "IK", pattern: noise.HandshakeIK, peer: serverKey.Public},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			a, b := net.Pipe()
+
+			done := make(chan *binproto.Conn)
+			go func() {
+				c, err := binproto.NewNoiseConn(b, noise.Config{
+					Pattern:       tt.pattern,
+					StaticKeypair: serverKey,
+				})
+				assert.Nil(t, err)
+				done <- c
+			}()
+
+			client, err := binproto.NewNoiseConn(a, noise.Config{
+				Pattern:       tt.pattern,
+				Initiator:     true,
+				StaticKeypair: clientKey,
+				PeerStatic:    tt.peer,
+			})
+			assert.Nil(t, err)
+			server := <-done
+			defer client.Close()
+			defer server.Close()
+
+			assert.Equal(t, serverKey.Public, client.RemoteStatic())
+			assert.Equal(t, clientKey.Public, server.RemoteStatic())
+
+			expected := []*binproto.Message{
+				newMessage(42, 3, 2),
+				newMessage(maxID, 15, 1e5),
+			}
+
+			go func() {
+				for _, m := range expected {
+					_, err := client.Send(m)
+					assert.Nil(t, err)
+				}
+			}()
+
+			for _, m := range expected {
+				res, err := server.ReadMessage()
+				assert.Nil(t, err)
+				assert.EqualValues(t, m, res)
+			}
+		})
+	}
+}
+
+func TestNoiseConnHandshakeFailure(t *testing.T) {
+	serverKey, _ := binproto.DefaultNoiseCipherSuite.GenerateKeypair(nil)
+	wrongKey, _ := binproto.DefaultNoiseCipherSuite.GenerateKeypair(nil)
+
+	a, b := net.Pipe()
+	defer a.Close()
+
+	go func() {
+		_, err := binproto.NewNoiseConn(b, noise.Config{
+			Pattern:       noise.HandshakeIK,
+			StaticKeypair: serverKey,
+		})
+		assert.ErrorIs(t, err, binproto.ErrNoiseHandshake)
+		b.Close()
+	}()
+
+	_, err := binproto.NewNoiseConn(a, noise.Config{
+		Pattern:       noise.HandshakeIK,
+		Initiator:     true,
+		StaticKeypair: wrongKey,
+		PeerStatic:    wrongKey.Public,
+	})
+	assert.NotNil(t, err)
+}
+
+// splitConn writes the first byte and then the next 9 bytes of a
+// write separately, each after a value is received from next.
+type splitConn struct {
+	net.Conn
+	next chan struct{}
+}
+
+func (c *splitConn) Write(p []byte) (int, error) {
+	if c.next == nil || len(p) < 10 {
+		return c.Conn.Write(p)
+	}
+	var n int
+	for _, end := range []int{1, 10, len(p)} {
+		if n > 0 {
+			<-c.next
+		}
+		m, err := c.Conn.Write(p[n:end])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func TestNoiseConnReadMessageContext(t *testing.T) {
+	clientKey, err := binproto.DefaultNoiseCipherSuite.GenerateKeypair(nil)
+	assert.Nil(t, err)
+	serverKey, err := binproto.DefaultNoiseCipherSuite.GenerateKeypair(nil)
+	assert.Nil(t, err)
+
+	a, b := net.Pipe()
+	sc := &splitConn{Conn: a}
+
+	done := make(chan *binproto.Conn)
+	go func() {
+		c, err := binproto.NewNoiseConn(b, noise.Config{StaticKeypair: serverKey})
+		assert.Nil(t, err)
+		done <- c
+	}()
+
+	client, err := binproto.NewNoiseConn(sc, noise.Config{Initiator: true, StaticKeypair: clientKey})
+	assert.Nil(t, err)
+	server := <-done
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = server.ReadMessageContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	// Interrupted in the middle of the frame header, and then of the frame.
+	sc.next = make(chan struct{})
+	go client.Send(newMessage(42, 3, 100))
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		_, err = server.ReadMessageContext(ctx)
+		cancel()
+		assert.Equal(t, context.DeadlineExceeded, err)
+		sc.next <- struct{}{}
+	}
+
+	m, err := server.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(42, 3, 100), m)
+}
@@ -0,0 +1,50 @@
+package binproto
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Payloads of pooled messages are allocated in power of two size
+// classes, from 64 bytes up to 64 KiB. Larger payloads are not pooled.
+const (
+	minPoolShift = 6
+	maxPoolShift = 16
+)
+
+var messagePools [maxPoolShift - minPoolShift + 1]sync.Pool
+
+// getMessage returns a message with a payload of n bytes from the pools.
+func getMessage(n int) *Message {
+	shift := minPoolShift
+	if n > 1<<minPoolShift {
+		shift = bits.Len(uint(n - 1))
+	}
+	if shift > maxPoolShift {
+		return &Message{Data: make([]byte, n)}
+	}
+	class := shift - minPoolShift
+	if v := messagePools[class].Get(); v != nil {
+		m := v.(*Message)
+		m.Data = m.Data[:n]
+		return m
+	}
+	return &Message{Data: make([]byte, n, 1<<shift), class: int8(class + 1)}
+}
+
+// Release returns a message read by a Reader in pooled mode to the pool
+// its payload was allocated from, so that it can be reused by later reads.
+// Neither the message nor its Data may be used after calling Release.
+// For any other message Release does nothing.
+func (m *Message) Release() {
+	if m.class == 0 {
+		return
+	}
+	class := int(m.class - 1)
+	if cap(m.Data) != 1<<(class+minPoolShift) {
+		// Data has been replaced.
+		return
+	}
+	m.ID, m.Channel, m.Data = 0, 0, m.Data[:0]
+	messagePools[class].Put(m)
+}
@@ -1,6 +1,7 @@
 package binproto
 
 import (
+	"bytes"
 	"errors"
 	"io"
 )
@@ -8,20 +9,22 @@ import (
 // A Reader implements convenience methods for reading requests
 // or responses from a binary protocol network connection.
 type Reader struct {
-	rd       io.Reader
-	r, w     int
-	buf      []byte
-	size     int
-	err      error
-	state    int
-	factor   uint64
-	varint   uint64
-	header   uint64
-	length   int
-	consumed int
-	messages []*Message
-	latest   []byte
-	missing  int
+	rd      io.Reader
+	r, w    int
+	start   int
+	buf     []byte
+	size    int
+	minSize int
+	maxSize int
+	err     error
+	d       Decoder
+	body    *bodyReader
+
+	compressed      bool
+	maxDecompressed int
+	checksum        bool
+	sync            bool
+	onSkip          func(int)
 }
 
 const (
@@ -29,11 +32,13 @@ const (
 	defaultMaxMessageSize    = 8 * 1024 * 1024
 	defaultBufSize           = 4096
 	maxConsecutiveEmptyReads = 100
+	maxVarintLen             = 10
 )
 
 var (
 	ErrMessageSizeExceeded = errors.New("binproto: message too big")
 	ErrMessageMalformed    = errors.New("binproto: message malformed")
+	ErrBodyClosed          = errors.New("binproto: read on closed message body")
 )
 
 // NewReader returns a new Reader reading from r.
@@ -46,23 +51,148 @@ func NewReader(rd io.Reader) *Reader {
 }
 
 // NewReaderSize returns a new Reader with the specified buffer size.
+// The buffer never grows, messages which do not fit in it are
+// reported with io.ErrShortBuffer.
 func NewReaderSize(rd io.Reader, size int) *Reader {
 	if size < minReadBufferSize {
 		size = minReadBufferSize
 	}
+	return NewReaderOptions(rd, &ReaderOptions{
+		BufferSize:    size,
+		MaxBufferSize: size,
+	})
+}
+
+// ReaderOptions configures a Reader.
+type ReaderOptions struct {
+	// BufferSize is the initial size of the internal buffer.
+	// If zero, 4096 bytes are allocated.
+	BufferSize int
+
+	// MaxBufferSize is the size the internal buffer may grow up to
+	// when a message does not fit in it. The buffer shrinks back to
+	// BufferSize once the message has been read.
+	// If zero, the buffer may grow large enough to hold any message
+	// of MaxMessageSize.
+	MaxBufferSize int
+
+	// MaxMessageSize is the maximum payload size of a message, larger
+	// messages are reported with ErrMessageSizeExceeded.
+	// If zero, 8 MiB is used.
+	MaxMessageSize int
+
+	// Pool makes ReadMessage allocate payloads from shared pools. Messages
+	// read in this mode should be returned with Release once they are no
+	// longer used, which makes reading free of allocations.
+	Pool bool
+
+	// Compressed enables the compression framing, see
+	// WriterOptions.Compressed. Payloads are decompressed with the
+	// registered Compressor of their Compression.
+	Compressed bool
+
+	// MaxDecompressedSize is the maximum size of a decompressed payload,
+	// larger payloads are reported with ErrMessageSizeExceeded.
+	// If zero, MaxMessageSize is used.
+	MaxDecompressedSize int
+
+	// Checksum enables the verification of the CRC-32C trailers of
+	// frames, see WriterOptions.Checksum. A mismatch is reported with
+	// a *MessageError wrapping ErrChecksumMismatch. The trailer does
+	// not count against MaxMessageSize, and the bodies returned by
+	// NextMessage are read whole to be verified, so they are subject
+	// to it.
+	Checksum bool
+
+	// SelfSync enables the self-synchronizing framing, see
+	// WriterOptions.SelfSync, in which frames which are corrupted,
+	// truncated or too large are skipped, rather than failing the
+	// Reader. Checksum and Pool have no effect in this framing.
+	SelfSync bool
+
+	// OnSkip, if not nil, is called with the number of bytes skipped
+	// when looking for the next valid frame in the self-synchronizing
+	// framing.
+	OnSkip func(n int)
+}
+
+// NewReaderOptions returns a new Reader configured by opts.
+// A nil opts is equivalent to a zero ReaderOptions.
+func NewReaderOptions(rd io.Reader, opts *ReaderOptions) *Reader {
 	r := new(Reader)
-	r.reset(make([]byte, size), rd)
+	r.init(rd, opts)
 	return r
 }
 
-func (b *Reader) fill() {
-	if b.r > 0 {
-		if b.r != b.w {
-			copy(b.buf, b.buf[b.r:b.w])
+func (b *Reader) init(rd io.Reader, opts *ReaderOptions) {
+	var o ReaderOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.BufferSize <= 0 {
+		o.BufferSize = defaultBufSize
+	}
+	if o.BufferSize < minReadBufferSize {
+		o.BufferSize = minReadBufferSize
+	}
+	if o.MaxMessageSize <= 0 {
+		o.MaxMessageSize = defaultMaxMessageSize
+	}
+	if o.MaxBufferSize <= 0 {
+		// Room for the framing, which may be enabled later by a Conn.
+		o.MaxBufferSize = o.MaxMessageSize + 2*maxVarintLen + checksumSize + 1
+		if o.SelfSync {
+			// Room for the encoding, the checksum and the compression.
+			o.MaxBufferSize += o.MaxBufferSize/254 + checksumSize + 2
 		}
-		b.w -= b.r
-		b.r = 0
 	}
+	if o.MaxBufferSize < o.BufferSize {
+		o.MaxBufferSize = o.BufferSize
+	}
+	b.reset(make([]byte, o.BufferSize), rd)
+	b.minSize = o.BufferSize
+	b.maxSize = o.MaxBufferSize
+	b.d.maxMsg = o.MaxMessageSize
+	b.d.pool = o.Pool
+	if o.Compressed {
+		b.setCompression(o.MaxDecompressedSize)
+	}
+	b.setChecksum(o.Checksum)
+	b.sync = o.SelfSync
+	b.onSkip = o.OnSkip
+}
+
+// setCompression enables the compression framing.
+func (b *Reader) setCompression(maxSize int) {
+	if maxSize <= 0 {
+		maxSize = b.d.maxMsg
+	}
+	b.compressed = true
+	b.maxDecompressed = maxSize
+	b.d.overhead = b.overhead()
+}
+
+// setChecksum enables or disables the verification of checksums.
+func (b *Reader) setChecksum(checksum bool) {
+	b.checksum = checksum
+	b.d.overhead = b.overhead()
+}
+
+// overhead returns the number of bytes the framing adds to payloads,
+// which do not count against the maximum message size.
+func (b *Reader) overhead() int {
+	n := 0
+	if b.checksum {
+		n += checksumSize
+	}
+	if b.compressed {
+		n++
+	}
+	return n
+}
+
+func (b *Reader) fill() {
+	b.compact()
 
 	length := len(b.buf)
 
@@ -77,7 +207,7 @@ func (b *Reader) fill() {
 		}
 		b.w += n
 		if err != nil {
-			if errors.Is(err, io.EOF) && b.state != 0 {
+			if errors.Is(err, io.EOF) && b.d.state != 0 {
 				err = io.ErrUnexpectedEOF
 			}
 			b.err = err
@@ -96,49 +226,56 @@ func (b *Reader) fill() {
 }
 
 // ReadMessage reads a single message from r.
+//
+// A header which does not fit in 64 bits, and so carries an ID of 2^60
+// or more, violates the protocol and is reported with ErrInvalidID.
 func (b *Reader) ReadMessage() (message *Message, err error) {
+	if err = b.discardBody(); err != nil {
+		return nil, err
+	}
+
+	if b.sync {
+		return b.readSync()
+	}
+
+	b.start = b.r
+
 	for {
-		if b.err != nil {
-			message = nil
-			b.r = b.w
-			err = b.readErr()
+		// Found message?
+		if n := len(b.d.messages); n > 0 {
+			message = b.d.messages[0]
+			copy(b.d.messages, b.d.messages[1:])
+			b.d.messages[n-1] = nil
+			b.d.messages = b.d.messages[:n-1]
+			b.shrink()
 			break
 		}
 
-		// Found message?
-		if len(b.messages) > 0 {
-			message, b.messages = b.messages[0], b.messages[1:]
-			b.missing = 0
-			copy(b.buf, b.buf[b.r:b.w])
-			b.w -= b.r
-			b.r = 0
+		// Decode what was read along with an error before reporting it,
+		// so that a timeout does not lose the bytes of a message.
+		pending := b.r < b.w || (b.d.state == 2 && b.d.length == 0)
+
+		if b.err != nil && (!pending || !isTimeout(b.err)) {
+			b.r = b.w
+			err = b.readErr()
 			break
 		}
 
 		// Reading ok?
-		if b.state == 0 && b.r > 1 {
+		if b.d.state == 0 && b.r-b.start > 1 {
 			b.r = b.w
 			err = io.ErrNoProgress
 			break
 		}
 
-		if b.r < b.w {
-			if b.state == 2 {
-				b.r = b.readMessage()
-			} else {
-				b.r = b.readVarint()
-			}
-			continue
-		}
-
-		if b.state == 2 && b.length == 0 {
-			b.r = b.readMessage()
+		if pending {
+			b.decode()
 			continue
 		}
 
 		// Is buffer big enough?
-		remaining := b.length - b.consumed
-		if b.w+remaining > b.size {
+		remaining := b.d.length - b.d.consumed
+		if n := b.w - b.start + remaining; n > b.size && !b.grow(n) {
 			b.r = b.w
 			err = io.ErrShortBuffer
 			break
@@ -147,117 +284,318 @@ func (b *Reader) ReadMessage() (message *Message, err error) {
 		b.fill()
 	}
 
+	if message != nil && (b.checksum || b.compressed) {
+		if err = b.unframe(message); err != nil {
+			message = nil
+		}
+	}
+
 	return
 }
 
-// Reset resets this Reader with the new source r, using
-// the existing buffer.
-func (b *Reader) Reset(r io.Reader) {
-	if b.buf == nil {
-		b.buf = make([]byte, defaultBufSize)
+// unframe verifies the checksum and decompresses the payload of m.
+func (b *Reader) unframe(m *Message) error {
+	if b.checksum {
+		data, err := verifyChecksum(m.ID, m.Channel, m.Data)
+		if err != nil {
+			return &MessageError{ID: m.ID, Channel: m.Channel, Err: err}
+		}
+		m.Data = data
 	}
-	b.reset(b.buf, r)
+	if !b.compressed {
+		return nil
+	}
+	return b.decompressMessage(m)
+}
+
+// decompressMessage decompresses the payload of m.
+func (b *Reader) decompressMessage(m *Message) error {
+	if m.class != 0 && len(m.Data) > 0 && m.Data[0] == byte(CompressionNone) {
+		// Keep the payload at the start of its pooled buffer.
+		n := copy(m.Data, m.Data[1:])
+		m.Data = m.Data[:n]
+		return nil
+	}
+	data, err := decompress(m.Data, b.maxDecompressed)
+	if err != nil {
+		return &MessageError{ID: m.ID, Channel: m.Channel, Err: err}
+	}
+	m.Data = data
+	return nil
 }
 
-func (b *Reader) next() bool {
-	switch b.state {
-	case 0:
-		b.state = 1
-		b.factor = 1
-		b.length = int(b.varint)
-		b.consumed = 0
-		b.varint = 0
-		if b.length == 0 {
-			b.state = 0
+// NextMessage reads the header of the next message and returns it
+// along with a reader for its payload, which is not copied into Data
+// and is not subject to the maximum message size.
+// The body reader also implements Len() int, which returns the number
+// of payload bytes that have not been read yet.
+//
+// The body is valid until the next call to NextMessage or ReadMessage,
+// which discard any unread part of it.
+func (b *Reader) NextMessage() (*Message, io.Reader, error) {
+	if err := b.discardBody(); err != nil {
+		return nil, nil, err
+	}
+
+	if b.sync {
+		m, err := b.readSync()
+		if err != nil {
+			return nil, nil, err
+		}
+		data := m.Data
+		m.Data = nil
+		return m, bytes.NewReader(data), nil
+	}
+
+	b.d.stream = true
+	defer func() { b.d.stream = false }()
+
+	b.start = b.r
+
+	for b.d.state != 2 {
+		if b.err != nil {
+			b.r = b.w
+			return nil, nil, b.readErr()
 		}
 
-		return true
-	case 1:
-		b.state = 2
-		b.factor = 1
-		b.header = b.varint
-		b.length -= b.consumed
-		b.consumed = 0
-		b.varint = 0
-		if b.length < 0 || b.length > defaultMaxMessageSize {
-			b.err = ErrMessageSizeExceeded
-
-			return false
+		if b.d.state == 0 && b.r-b.start > 1 {
+			b.r = b.w
+			return nil, nil, io.ErrNoProgress
 		}
-		extra := len(b.buf[:b.w]) - b.r
-		if b.length > extra {
-			b.missing = b.length - extra
+
+		if b.r < b.w {
+			b.decode()
+			continue
 		}
 
-		return true
-	case 2:
-		b.state = 0
-		b.messages = append(b.messages, NewMessage(int(b.header>>4), rune(b.header&0b1111), b.latest))
-		b.latest = nil
+		b.fill()
+	}
 
-		return b.err == nil
-	default:
-		return false
+	m := NewMessage(int(b.d.header>>4), rune(b.d.header&0b1111), nil)
+	body := &bodyReader{b: b, n: b.d.length}
+	if body.n == 0 {
+		body.finish()
+	} else {
+		b.body = body
 	}
-}
 
-func (b *Reader) readMessage() int {
-	data, offset := b.buf[:b.w], b.r
-	length := len(data)
-
-	free := length - offset
-	if free >= b.length {
-		if b.latest != nil {
-			copy(b.latest[len(b.latest)-b.length:], data[offset:])
-		} else {
-			b.latest = make([]byte, (offset+b.length)-offset)
-			copy(b.latest, data[offset:offset+b.length])
+	if b.checksum {
+		// The payload can only be trusted once it is verified.
+		if body.Len()-b.overhead() > b.d.maxMsg {
+			return nil, nil, &MessageError{ID: m.ID, Channel: m.Channel, Err: ErrMessageSizeExceeded}
 		}
+		data, err := readAll(body, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		m.Data = data
+		if err := b.unframe(m); err != nil {
+			return nil, nil, err
+		}
+		data, m.Data = m.Data, nil
+		return m, bytes.NewReader(data), nil
+	}
 
-		offset += b.length
-
-		if b.next() {
-			return offset
+	if b.compressed {
+		r, err := b.decompressBody(body)
+		if err != nil {
+			return nil, nil, &MessageError{ID: m.ID, Channel: m.Channel, Err: err}
 		}
+		return m, r, nil
+	}
+
+	return m, body, nil
+}
 
-		return length
+// decompressBody returns a reader for the payload of a body in the
+// compression framing. Compressed payloads are read and decompressed
+// at once.
+func (b *Reader) decompressBody(body *bodyReader) (io.Reader, error) {
+	var c [1]byte
+	if _, err := io.ReadFull(body, c[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = ErrMessageMalformed
+		}
+		return nil, err
+	}
+	if Compression(c[0]) == CompressionNone {
+		return body, nil
+	}
+	if body.Len() > b.d.maxMsg {
+		return nil, ErrMessageSizeExceeded
+	}
+	data, err := readAll(body, []byte{c[0]})
+	if err != nil {
+		return nil, err
 	}
+	if data, err = decompress(data, b.maxDecompressed); err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// readAll appends the rest of r to data.
+func readAll(r io.Reader, data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(data)
+	_, err := buf.ReadFrom(r)
+	return buf.Bytes(), err
+}
 
-	if b.latest == nil {
-		b.latest = make([]byte, b.length)
+// idle reports whether no part of the next message has been read.
+func (b *Reader) idle() bool {
+	return b.body == nil && len(b.d.messages) == 0 && b.d.state == 0 && b.d.consumed == 0 && b.r == b.w
+}
+
+// isTimeout reports whether err is a timeout, after which reading
+// can be resumed.
+func isTimeout(err error) bool {
+	var t interface{ Timeout() bool }
+	return errors.As(err, &t) && t.Timeout()
+}
+
+// decode runs the state machine on the buffered data.
+func (b *Reader) decode() {
+	if b.d.state == 2 {
+		b.r = b.d.readMessage(b.buf[:b.w], b.r)
+	} else {
+		b.r = b.d.readVarint(b.buf[:b.w], b.r)
+	}
+	if b.d.err != nil {
+		b.err, b.d.err = b.d.err, nil
 	}
+}
 
-	copy(b.latest[len(b.latest)-b.length:], data[offset:])
+// compact moves the unread data to the beginning of the buffer.
+// It is called before filling the buffer, when all of the data has
+// been decoded, rather than after every message.
+func (b *Reader) compact() {
+	if b.r > 0 {
+		copy(b.buf, b.buf[b.r:b.w])
+		b.w -= b.r
+		b.r = 0
+	}
+	b.start = 0
+}
 
-	b.length -= free
+func (b *Reader) discardBody() error {
+	if b.body == nil {
+		return nil
+	}
+	_, err := io.Copy(io.Discard, b.body)
+	return err
+}
 
-	return length
+type bodyReader struct {
+	b *Reader
+	n int
 }
 
-func (b *Reader) readVarint() int {
-	data, offset := b.buf[:b.w], b.r
+func (r *bodyReader) Len() int { return r.n }
 
-	for ; offset < len(data); offset++ {
-		b.varint += uint64(data[offset]&127) * b.factor
-		b.consumed += 1
+func (r *bodyReader) Read(p []byte) (n int, err error) {
+	b := r.b
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	if b.body != r {
+		return 0, ErrBodyClosed
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
 
-		if data[offset] < 128 {
-			offset += 1
+	if b.r == b.w {
+		if b.err != nil {
+			return 0, b.readErr()
+		}
 
-			if b.next() {
-				return offset
+		if len(p) >= len(b.buf) {
+			// Large read, empty buffer.
+			// Read directly into p to avoid copy.
+			b.r, b.w = 0, 0
+			n, err = b.rd.Read(p)
+			if n < 0 {
+				panic("binproto: reader returned negative count from Read")
+			}
+			r.n -= n
+			if err != nil {
+				if errors.Is(err, io.EOF) && r.n > 0 {
+					err = io.ErrUnexpectedEOF
+				}
+				b.err = err
+			}
+			if r.n == 0 {
+				r.finish()
 			}
-			return len(data)
+			if n > 0 {
+				return n, nil
+			}
+			return 0, b.readErr()
 		}
 
-		b.factor *= 128
+		b.fill()
+		if b.r == b.w {
+			return 0, b.readErr()
+		}
+	}
+
+	n = copy(p, b.buf[b.r:b.w])
+	b.r += n
+	r.n -= n
+	if r.n == 0 {
+		r.finish()
+	}
+
+	return n, nil
+}
+
+func (r *bodyReader) finish() {
+	r.n = 0
+	b := r.b
+	b.d.state = 0
+	b.d.length = 0
+	b.body = nil
+}
+
+// grow grows the buffer to hold at least n bytes, and reports
+// whether it was possible without exceeding the maximum size.
+func (b *Reader) grow(n int) bool {
+	if n > b.maxSize {
+		return false
+	}
+	size := 2 * len(b.buf)
+	if size < n {
+		size = n
 	}
+	if size > b.maxSize {
+		size = b.maxSize
+	}
+	buf := make([]byte, size)
+	copy(buf, b.buf[:b.w])
+	b.buf = buf
+	b.size = size
+	return true
+}
 
-	if b.consumed >= 11 {
-		b.err = ErrMessageMalformed
+// shrink shrinks a grown buffer back to its initial size
+// if the unread data fits in it.
+func (b *Reader) shrink() {
+	if b.size > b.minSize && b.w-b.r <= b.minSize {
+		b.compact()
+		buf := make([]byte, b.minSize)
+		copy(buf, b.buf[:b.w])
+		b.buf = buf
+		b.size = b.minSize
 	}
+}
 
-	return len(data)
+// Reset resets this Reader with the new source r, using
+// the existing buffer.
+func (b *Reader) Reset(r io.Reader) {
+	if b.buf == nil {
+		b.buf = make([]byte, defaultBufSize)
+	}
+	b.reset(b.buf, r)
 }
 
 func (b *Reader) readErr() error {
@@ -267,10 +605,26 @@ func (b *Reader) readErr() error {
 }
 
 func (b *Reader) reset(buf []byte, r io.Reader) {
+	minSize, maxSize, maxMsg, pool := b.minSize, b.maxSize, b.d.maxMsg, b.d.pool
+	compressed, maxDecompressed, checksum := b.compressed, b.maxDecompressed, b.checksum
+	sync, onSkip := b.sync, b.onSkip
+	if minSize == 0 {
+		minSize, maxSize = len(buf), len(buf)
+	}
 	*b = Reader{
-		rd:     r,
-		buf:    buf,
-		size:   len(buf),
-		factor: 1,
+		rd:      r,
+		buf:     buf,
+		size:    len(buf),
+		minSize: minSize,
+		maxSize: maxSize,
+		d:       *NewDecoder(maxMsg),
+
+		compressed:      compressed,
+		maxDecompressed: maxDecompressed,
+		checksum:        checksum,
+		sync:            sync,
+		onSkip:          onSkip,
 	}
+	b.d.pool = pool
+	b.d.overhead = b.overhead()
 }
@@ -410,6 +410,157 @@ func TestReadMessage(t *testing.T) {
 	}
 }
 
+func TestReaderOptions(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		opts   *binproto.ReaderOptions
+		reads  []byte
+		expect []interface{}
+	}{
+		{
+			desc: "grow and shrink",
+			opts: &binproto.ReaderOptions{BufferSize: 16},
+			reads: flattened([][]byte{
+				newBytes(5, 10, 2, 0, 0),
+				newBytes(42, 3, 1e5, 0, 0),
+				newBytes(maxID, 1, 5, 0, 0),
+				newBytes(7, 2, 3e5, 0, 0),
+			}),
+			expect: expecting(
+				newMessage(5, 10, 2),
+				newMessage(42, 3, 1e5),
+				newMessage(maxID, 1, 5),
+				newMessage(7, 2, 3e5),
+				io.EOF,
+			),
+		},
+		{
+			desc:   "max buffer size",
+			opts:   &binproto.ReaderOptions{BufferSize: 16, MaxBufferSize: 1024},
+			reads:  flattened([][]byte{newBytes(5, 10, 2, 0, 0), newBytes(42, 3, 1024, 0, 0)}),
+			expect: expecting(newMessage(5, 10, 2), io.ErrShortBuffer),
+		},
+		{
+			desc:   "max message size",
+			opts:   &binproto.ReaderOptions{MaxMessageSize: 1024},
+			reads:  flattened([][]byte{newBytes(42, 3, 1024, 0, 0), newBytes(42, 3, 1025, 0, 0)}),
+			expect: expecting(newMessage(42, 3, 1024), binproto.ErrMessageSizeExceeded),
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			r := binproto.NewReaderOptions(bytes.NewReader(tt.reads), tt.opts)
+			for _, v := range tt.expect {
+				res, err := r.ReadMessage()
+				if expectedErr, ok := v.(error); ok {
+					assert.Equal(t, expectedErr, err)
+				} else {
+					assert.Nil(t, err)
+					assert.EqualValues(t, v, res)
+				}
+			}
+		})
+	}
+}
+
+func TestNextMessage(t *testing.T) {
+	data := []byte(fill(1e5))
+	reads := flattened([][]byte{
+		newBytes(42, 3, 1e5, 0, 0),
+		newBytes(5, 10, 0, 0, 0),
+		newBytes(maxID, 1, 1e5, 0, 0),
+		newBytes(7, 2, 5, 0, 0),
+		newBytes(8, 2, 1e5, 0, 0),
+	})
+	r := binproto.NewReaderOptions(bytes.NewReader(reads), &binproto.ReaderOptions{
+		BufferSize:     16,
+		MaxMessageSize: 1024,
+	})
+
+	// Read the whole body.
+	m, body, err := r.NextMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, binproto.NewMessage(42, 3, nil), m)
+	b, err := io.ReadAll(body)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+
+	// Empty body.
+	m, body, err = r.NextMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, binproto.NewMessage(5, 10, nil), m)
+	n, err := body.Read(make([]byte, 1))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+
+	// Read part of the body.
+	m, body, err = r.NextMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, binproto.NewMessage(maxID, 1, nil), m)
+	b = make([]byte, 100)
+	_, err = io.ReadFull(body, b)
+	assert.Nil(t, err)
+	assert.Equal(t, data[:100], b)
+	assert.Equal(t, 99900, body.(interface{ Len() int }).Len())
+
+	// The rest is discarded.
+	res, err := r.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(7, 2, 5), res)
+	_, err = body.Read(b)
+	assert.Equal(t, io.EOF, err)
+
+	// Without reading the body.
+	_, body, err = r.NextMessage()
+	assert.Nil(t, err)
+	_, _, err = r.NextMessage()
+	assert.Equal(t, io.EOF, err)
+	_, err = body.Read(b)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestNextMessageUnexpectedEOF(t *testing.T) {
+	r := binproto.NewReader(bytes.NewReader(newBytes(42, 3, 1e4, 0, 5000)))
+	_, body, err := r.NextMessage()
+	assert.Nil(t, err)
+	_, err = io.ReadAll(body)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestReaderPool(t *testing.T) {
+	reads := flattened([][]byte{
+		newBytes(5, 10, 2, 0, 0),
+		newBytes(42, 3, 1e3, 0, 0),
+		newBytes(7, 2, 1e5, 0, 0),
+		newBytes(42, 3, 1e3, 0, 0),
+	})
+	r := binproto.NewReaderOptions(bytes.NewReader(reads), &binproto.ReaderOptions{Pool: true})
+
+	for _, expected := range []*binproto.Message{
+		newMessage(5, 10, 2),
+		newMessage(42, 3, 1e3),
+		newMessage(7, 2, 1e5),
+		newMessage(42, 3, 1e3),
+	} {
+		m, err := r.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, expected.ID, m.ID)
+		assert.Equal(t, expected.Channel, m.Channel)
+		assert.Equal(t, expected.Data, m.Data)
+		m.Release()
+	}
+
+	_, err := r.ReadMessage()
+	assert.Equal(t, io.EOF, err)
+
+	// Releasing a message which is not pooled does nothing.
+	m := newMessage(42, 3, 2)
+	m.Release()
+	assert.EqualValues(t, newMessage(42, 3, 2), m)
+}
+
 func BenchmarkReadMessage(b *testing.B) {
 	b.ReportAllocs()
 
@@ -433,6 +584,43 @@ func BenchmarkReadMessage(b *testing.B) {
 	}
 }
 
+// repeatReader reads the same bytes over and over.
+type repeatReader struct {
+	b []byte
+	i int
+}
+
+func (r *repeatReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		c := copy(p[n:], r.b[r.i:])
+		n += c
+		r.i = (r.i + c) % len(r.b)
+	}
+	return n, nil
+}
+
+func BenchmarkReadMessagePooled(b *testing.B) {
+	b.ReportAllocs()
+
+	data := []byte(fill(56))
+	r := binproto.NewReaderOptions(&repeatReader{b: send(42, 3, data)}, &binproto.ReaderOptions{
+		BufferSize: 256,
+		Pool:       true,
+	})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m, err := r.ReadMessage()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if m.ID != 42 || m.Channel != 3 || len(m.Data) != len(data) {
+			b.Fatal(fmt.Sprintf("expected: %d %d %s, got: %d %d %s", 42, 3, string(data), m.ID, m.Channel, string(m.Data)))
+		}
+		m.Release()
+	}
+}
+
 type testReader struct {
 	q [][]byte
 }
@@ -469,13 +657,12 @@ func newBytes(id int, ch rune, l int, start, end int) []byte {
 }
 
 func fill(times int) string {
-	s := ""
+	s := make([]byte, times)
 	chars := "abcdefghijklmnopqrstuvwxyz"
 	for i := 0; i < times; i++ {
-		pos := i % len(chars)
-		s += chars[pos : pos+1]
+		s[i] = chars[i%len(chars)]
 	}
-	return s
+	return string(s)
 }
 
 func runTest(t *testing.T, tt testCase) {
@@ -0,0 +1,355 @@
+package binproto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMinBackoff     = 100 * time.Millisecond
+	defaultMaxBackoff     = 30 * time.Second
+	defaultSendQueueSize  = 128
+	reconnectReadChanSize = 64
+)
+
+var (
+	ErrReconnectFailed = errors.New("binproto: reconnect failed")
+	ErrQueueFull       = errors.New("binproto: send queue full")
+)
+
+// ReconnectConfig configures a ReconnectingConn.
+type ReconnectConfig struct {
+	// MinBackoff and MaxBackoff bound the delay between dial attempts,
+	// which doubles after every failed attempt, with random jitter.
+	// A connection which is lost before reading any message counts as
+	// a failed attempt. If zero, 100ms and 30s are used.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// MaxRetries is the number of consecutive failed dial attempts after
+	// which the ReconnectingConn gives up, and its methods return an error
+	// wrapping ErrReconnectFailed. If zero, it retries forever.
+	MaxRetries int
+
+	// QueueSize is the number of messages Send queues while disconnected,
+	// beyond which it returns ErrQueueFull. If zero, 128 is used.
+	QueueSize int
+
+	// OnConnect, if not nil, is called with every new connection, before
+	// the queued messages are sent on it. Messages sent on the ReconnectingConn
+	// while it runs are queued after them.
+	OnConnect func(*Conn)
+
+	// OnDisconnect, if not nil, is called with the error which
+	// ended a connection.
+	OnDisconnect func(error)
+
+	// ConnConfig configures the connections of DialReconnecting.
+	ConnConfig *ConnConfig
+}
+
+// A ReconnectingConn is a connection which is dialed again, with
+// exponential backoff, whenever it is lost. Messages sent while it is
+// disconnected are queued and sent once it is connected again.
+//
+// Messages are delivered at least once: messages of a Send which failed
+// because the connection was lost are sent again on the next one.
+// A queued message which the next connection rejects with a
+// *MessageError, such as one above its negotiated MaxMessageSize,
+// is dropped.
+type ReconnectingConn struct {
+	dial     func(context.Context) (*Conn, error)
+	config   ReconnectConfig
+	ctx      context.Context
+	cancel   context.CancelFunc
+	messages chan *Message
+	done     chan struct{}
+	exited   chan struct{}
+	once     sync.Once
+
+	mu    sync.Mutex
+	conn  *Conn
+	queue []*Message
+	err   error
+}
+
+// NewReconnectingConn returns a new ReconnectingConn, which uses dial to
+// connect, configured by config. A nil config is equivalent to a zero
+// ReconnectConfig. It starts connecting in the background.
+func NewReconnectingConn(dial func(context.Context) (*Conn, error), config *ReconnectConfig) *ReconnectingConn {
+	c := &ReconnectingConn{
+		dial:     dial,
+		messages: make(chan *Message, reconnectReadChanSize),
+		done:     make(chan struct{}),
+		exited:   make(chan struct{}),
+	}
+	if config != nil {
+		c.config = *config
+	}
+	if c.config.MinBackoff <= 0 {
+		c.config.MinBackoff = defaultMinBackoff
+	}
+	if c.config.MaxBackoff <= 0 {
+		c.config.MaxBackoff = defaultMaxBackoff
+	}
+	if c.config.MaxBackoff < c.config.MinBackoff {
+		c.config.MaxBackoff = c.config.MinBackoff
+	}
+	if c.config.QueueSize <= 0 {
+		c.config.QueueSize = defaultSendQueueSize
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	go c.run()
+	return c
+}
+
+// DialReconnecting returns a new ReconnectingConn connecting to the given
+// address on the given network with DialContext, using config.ConnConfig.
+func DialReconnecting(network, addr string, config *ReconnectConfig) *ReconnectingConn {
+	var cc *ConnConfig
+	if config != nil {
+		cc = config.ConnConfig
+	}
+	return NewReconnectingConn(func(ctx context.Context) (*Conn, error) {
+		return DialContext(ctx, network, addr, cc)
+	}, config)
+}
+
+// Send sends messages on the current connection, or queues them if there
+// is none. It returns ErrQueueFull if the queue has no room for them, and
+// a *MessageError, without sending any of them, if the connection rejects
+// one of them.
+func (c *ReconnectingConn) Send(m ...*Message) error {
+	for i, msg := range m {
+		if err := msg.validate(); err != nil {
+			err.(*MessageError).Index = i
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	conn, err := c.conn, c.err
+	if err == nil && conn == nil {
+		err = c.enqueue(m)
+	}
+	c.mu.Unlock()
+
+	if err != nil || conn == nil {
+		return err
+	}
+
+	if _, err := conn.Send(m...); err != nil {
+		var merr *MessageError
+		if errors.As(err, &merr) {
+			// Nothing was written, and it would fail again.
+			return err
+		}
+		// Closing the connection makes its read loop reconnect.
+		conn.Close()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.conn == conn {
+			c.conn = nil
+		}
+		if c.err != nil {
+			return c.err
+		}
+		c.requeue(m)
+		return nil
+	}
+	return nil
+}
+
+// enqueue adds messages to the queue.
+func (c *ReconnectingConn) enqueue(m []*Message) error {
+	if len(c.queue)+len(m) > c.config.QueueSize {
+		return ErrQueueFull
+	}
+	c.queue = append(c.queue, m...)
+	return nil
+}
+
+// requeue puts back messages which failed to be sent in front of the
+// queue, even if it grows beyond its size, as they were accepted.
+func (c *ReconnectingConn) requeue(m []*Message) {
+	c.queue = append(m[:len(m):len(m)], c.queue...)
+}
+
+// ReadMessage returns the next message read from any of the connections.
+// It blocks while disconnected, and only fails once the ReconnectingConn
+// is closed or has given up reconnecting.
+func (c *ReconnectingConn) ReadMessage() (*Message, error) {
+	select {
+	case m := <-c.messages:
+		return m, nil
+	case <-c.done:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return nil, c.err
+	}
+}
+
+// Close closes the current connection and stops reconnecting.
+func (c *ReconnectingConn) Close() error {
+	c.fail(net.ErrClosed)
+	c.cancel()
+	c.mu.Lock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.mu.Unlock()
+	<-c.exited
+	return nil
+}
+
+func (c *ReconnectingConn) fail(err error) {
+	c.once.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.queue = nil
+		c.mu.Unlock()
+		close(c.done)
+	})
+}
+
+func (c *ReconnectingConn) run() {
+	defer close(c.exited)
+
+	var attempt int
+	for {
+		conn, n, err := c.connect(attempt)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		read, err := c.serve(conn)
+		conn.Close()
+		if read {
+			attempt = 0
+		} else {
+			// Such as a peer accepting connections and closing
+			// them right away.
+			attempt = n + 1
+		}
+
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+		if c.config.OnDisconnect != nil {
+			c.config.OnDisconnect(err)
+		}
+	}
+}
+
+// connect dials until it succeeds, the retry budget is exhausted or
+// the ReconnectingConn is closed, backing off from the given number
+// of failed attempts. It returns the number of the successful one.
+func (c *ReconnectingConn) connect(attempt int) (*Conn, int, error) {
+	for failed := 0; ; attempt++ {
+		if attempt > 0 {
+			t := time.NewTimer(c.backoff(attempt - 1))
+			select {
+			case <-t.C:
+			case <-c.done:
+				t.Stop()
+				return nil, 0, net.ErrClosed
+			}
+		}
+
+		conn, err := c.dial(c.ctx)
+		if err == nil {
+			return conn, attempt, nil
+		}
+		if c.ctx.Err() != nil {
+			return nil, 0, net.ErrClosed
+		}
+		if failed++; c.config.MaxRetries > 0 && failed >= c.config.MaxRetries {
+			return nil, 0, fmt.Errorf("%w: %v", ErrReconnectFailed, err)
+		}
+	}
+}
+
+// backoff returns the delay before the next dial attempt, which is
+// between half and all of the exponential backoff.
+func (c *ReconnectingConn) backoff(attempt int) time.Duration {
+	d := c.config.MaxBackoff
+	if attempt < 32 {
+		if b := c.config.MinBackoff << uint(attempt); b > 0 && b < d {
+			d = b
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// serve sends the queued messages on conn, and then reads from it
+// until it fails. It reports whether any message was read.
+func (c *ReconnectingConn) serve(conn *Conn) (bool, error) {
+	if c.config.OnConnect != nil {
+		c.config.OnConnect(conn)
+	}
+
+	// Send the queue, including what is queued meanwhile, before
+	// accepting messages for the connection.
+	for {
+		c.mu.Lock()
+		if c.err != nil {
+			c.mu.Unlock()
+			return false, c.err
+		}
+		queue := c.queue
+		if len(queue) == 0 {
+			c.conn = conn
+			c.mu.Unlock()
+			break
+		}
+		c.queue = nil
+		c.mu.Unlock()
+
+		if _, err := conn.Send(queue...); err != nil {
+			var merr *MessageError
+			rejected := errors.As(err, &merr)
+			if rejected {
+				// Nothing was written; drop the message which
+				// would fail again, and send the others.
+				queue = append(queue[:merr.Index:merr.Index], queue[merr.Index+1:]...)
+			}
+			c.mu.Lock()
+			if c.err == nil {
+				c.requeue(queue)
+			}
+			c.mu.Unlock()
+			if rejected {
+				continue
+			}
+			return false, err
+		}
+	}
+
+	defer func() {
+		c.mu.Lock()
+		if c.conn == conn {
+			c.conn = nil
+		}
+		c.mu.Unlock()
+	}()
+
+	for read := false; ; read = true {
+		m, err := conn.ReadMessage()
+		if err != nil {
+			return read, err
+		}
+		select {
+		case c.messages <- m:
+		case <-c.done:
+			return true, net.ErrClosed
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package binproto_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/onur1/binproto"
+	"github.com/stretchr/testify/assert"
+)
+
+// echoDialer dials echo servers over net.Pipe, and fails while down.
+type echoDialer struct {
+	mu     sync.Mutex
+	down   bool
+	dials  int
+	server *binproto.Conn
+	config *binproto.ConnConfig // of the client side
+}
+
+func (d *echoDialer) dial(ctx context.Context) (*binproto.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.dials++
+	if d.down {
+		return nil, errors.New("down")
+	}
+	a, b := net.Pipe()
+	server := binproto.NewConn(b)
+	d.server = server
+	go func() {
+		for {
+			m, err := server.ReadMessage()
+			if err != nil {
+				server.Close()
+				return
+			}
+			server.Send(m)
+		}
+	}()
+	return binproto.NewConnConfig(a, d.config), nil
+}
+
+func (d *echoDialer) setDown(down bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.down = down
+	if down && d.server != nil {
+		d.server.Close()
+	}
+}
+
+func TestReconnectingConn(t *testing.T) {
+	d := &echoDialer{}
+
+	connects, disconnects := make(chan *binproto.Conn, 10), make(chan error, 10)
+	c := binproto.NewReconnectingConn(d.dial, &binproto.ReconnectConfig{
+		MinBackoff:   time.Millisecond,
+		MaxBackoff:   5 * time.Millisecond,
+		OnConnect:    func(conn *binproto.Conn) { connects <- conn },
+		OnDisconnect: func(err error) { disconnects <- err },
+	})
+	defer c.Close()
+
+	<-connects
+
+	assert.Nil(t, c.Send(newMessage(1, 1, 2)))
+	m, err := c.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(1, 1, 2), m)
+
+	// Messages are queued while disconnected.
+	d.setDown(true)
+	assert.NotNil(t, <-disconnects)
+
+	for i := 2; i < 5; i++ {
+		assert.Nil(t, c.Send(newMessage(i, 1, 2)))
+	}
+
+	d.setDown(false)
+	conn := <-connects
+	assert.NotNil(t, conn)
+
+	for i := 2; i < 5; i++ {
+		m, err := c.ReadMessage()
+		assert.Nil(t, err)
+		assert.EqualValues(t, newMessage(i, 1, 2), m)
+	}
+
+	assert.Nil(t, c.Close())
+	_, err = c.ReadMessage()
+	assert.Equal(t, net.ErrClosed, err)
+	assert.Equal(t, net.ErrClosed, c.Send(newMessage(1, 1, 2)))
+}
+
+func TestReconnectingConnQueueFull(t *testing.T) {
+	d := &echoDialer{down: true}
+	c := binproto.NewReconnectingConn(d.dial, &binproto.ReconnectConfig{
+		MinBackoff: time.Hour,
+		QueueSize:  2,
+	})
+	defer c.Close()
+
+	assert.Nil(t, c.Send(newMessage(1, 1, 2), newMessage(2, 1, 2)))
+	assert.Equal(t, binproto.ErrQueueFull, c.Send(newMessage(3, 1, 2)))
+
+	var merr *binproto.MessageError
+	assert.True(t, errors.As(c.Send(newMessage(-1, 1, 2)), &merr))
+}
+
+func TestReconnectingConnMessageError(t *testing.T) {
+	const controlID = 1<<60 - 1
+
+	// The largest ID is reserved on connections with keepalive.
+	d := &echoDialer{config: &binproto.ConnConfig{KeepAlive: time.Hour}}
+	connects := make(chan *binproto.Conn, 10)
+	c := binproto.NewReconnectingConn(d.dial, &binproto.ReconnectConfig{
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 5 * time.Millisecond,
+		OnConnect:  func(conn *binproto.Conn) { connects <- conn },
+	})
+	defer c.Close()
+
+	<-connects
+
+	var merr *binproto.MessageError
+	err := c.Send(newMessage(1, 1, 2), newMessage(controlID, 1, 2))
+	assert.True(t, errors.As(err, &merr))
+	assert.Equal(t, 1, merr.Index)
+	assert.Equal(t, binproto.ErrInvalidID, merr.Err)
+
+	// The connection is kept, and nothing was sent.
+	assert.Nil(t, c.Send(newMessage(2, 1, 2)))
+	m, err := c.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(2, 1, 2), m)
+
+	// A queued message rejected by the next connection is dropped.
+	// It is rejected right away until the connection is found lost.
+	d.setDown(true)
+	for {
+		if err := c.Send(newMessage(controlID, 1, 2), newMessage(3, 1, 2)); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	d.setDown(false)
+	<-connects
+	m, err = c.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(3, 1, 2), m)
+
+	select {
+	case <-connects:
+		t.Fatal("reconnected")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestReconnectingConnDropped(t *testing.T) {
+	// The peer accepts connections, and closes them right away.
+	var (
+		mu    sync.Mutex
+		dials int
+	)
+	dial := func(ctx context.Context) (*binproto.Conn, error) {
+		mu.Lock()
+		dials++
+		mu.Unlock()
+		a, b := net.Pipe()
+		b.Close()
+		return binproto.NewConn(a), nil
+	}
+	c := binproto.NewReconnectingConn(dial, &binproto.ReconnectConfig{
+		MinBackoff: 100 * time.Millisecond,
+	})
+	time.Sleep(500 * time.Millisecond)
+	c.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.LessOrEqual(t, dials, 5)
+}
+
+func TestReconnectingConnRetryBudget(t *testing.T) {
+	d := &echoDialer{down: true}
+	c := binproto.NewReconnectingConn(d.dial, &binproto.ReconnectConfig{
+		MinBackoff: time.Millisecond,
+		MaxRetries: 3,
+	})
+	defer c.Close()
+
+	_, err := c.ReadMessage()
+	assert.True(t, errors.Is(err, binproto.ErrReconnectFailed))
+	assert.True(t, errors.Is(c.Send(newMessage(1, 1, 2)), binproto.ErrReconnectFailed))
+
+	d.mu.Lock()
+	assert.Equal(t, 3, d.dials)
+	d.mu.Unlock()
+}
+
+func TestDialReconnecting(t *testing.T) {
+	s, addr, _ := newTestServer(t, binproto.HandlerFunc(func(c *binproto.Conn, m *binproto.Message) error {
+		_, err := c.Send(m)
+		return err
+	}))
+	defer s.Close()
+
+	c := binproto.DialReconnecting("tcp", addr, nil)
+	defer c.Close()
+
+	assert.Nil(t, c.Send(newMessage(42, 3, 2)))
+	m, err := c.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(42, 3, 2), m)
+}
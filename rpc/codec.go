@@ -0,0 +1,255 @@
+// Package rpc implements net/rpc client and server codecs which use
+// binproto for framing.
+//
+// Each request and each response is sent as two messages which carry
+// the sequence number of the call as their ID: the header on
+// HeaderChannel and the body on BodyChannel. Bodies are encoded with
+// a pluggable Codec.
+package rpc
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net/rpc"
+
+	"github.com/onur1/binproto"
+)
+
+const (
+	HeaderChannel rune = 0
+	BodyChannel   rune = 1
+)
+
+var ErrUnexpectedMessage = errors.New("binproto/rpc: unexpected message")
+
+// A Codec encodes and decodes the bodies of requests and responses.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// Gob encodes bodies with encoding/gob.
+	Gob Codec = gobCodec{}
+
+	// Binary encodes bodies implementing encoding.BinaryMarshaler and
+	// decodes them into values implementing encoding.BinaryUnmarshaler.
+	// Byte slices are sent as is.
+	Binary Codec = binaryCodec{}
+)
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type binaryCodec struct{}
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case encoding.BinaryMarshaler:
+		return v.MarshalBinary()
+	case []byte:
+		return v, nil
+	case *[]byte:
+		return *v, nil
+	}
+	return nil, fmt.Errorf("binproto/rpc: can not marshal %T", v)
+}
+
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	switch v := v.(type) {
+	case encoding.BinaryUnmarshaler:
+		return v.UnmarshalBinary(data)
+	case *[]byte:
+		*v = append((*v)[:0], data...)
+		return nil
+	}
+	return fmt.Errorf("binproto/rpc: can not unmarshal into %T", v)
+}
+
+type clientCodec struct {
+	conn  *binproto.Conn
+	codec Codec
+	id    int
+}
+
+// NewClientCodec returns a new rpc.ClientCodec using binproto framing
+// on conn, and codec to encode request bodies. If codec is nil, Gob
+// is used.
+func NewClientCodec(conn *binproto.Conn, codec Codec) rpc.ClientCodec {
+	if codec == nil {
+		codec = Gob
+	}
+	return &clientCodec{conn: conn, codec: codec}
+}
+
+func (c *clientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	data, err := c.codec.Marshal(body)
+	if err != nil {
+		return err
+	}
+	id := int(r.Seq)
+	_, err = c.conn.Send(
+		binproto.NewMessage(id, HeaderChannel, []byte(r.ServiceMethod)),
+		binproto.NewMessage(id, BodyChannel, data),
+	)
+	return err
+}
+
+func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	m, err := readMessage(c.conn, HeaderChannel, -1)
+	if err != nil {
+		return err
+	}
+	method, rest, err := readString(m.Data)
+	if err != nil {
+		return err
+	}
+	errMsg, _, err := readString(rest)
+	if err != nil {
+		return err
+	}
+	c.id = m.ID
+	r.ServiceMethod = method
+	r.Seq = uint64(m.ID)
+	r.Error = errMsg
+	return nil
+}
+
+func (c *clientCodec) ReadResponseBody(body interface{}) error {
+	m, err := readMessage(c.conn, BodyChannel, c.id)
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		return nil
+	}
+	return c.codec.Unmarshal(m.Data, body)
+}
+
+func (c *clientCodec) Close() error {
+	return c.conn.Close()
+}
+
+type serverCodec struct {
+	conn  *binproto.Conn
+	codec Codec
+	id    int
+}
+
+// NewServerCodec returns a new rpc.ServerCodec using binproto framing
+// on conn, and codec to encode response bodies. If codec is nil, Gob
+// is used.
+func NewServerCodec(conn *binproto.Conn, codec Codec) rpc.ServerCodec {
+	if codec == nil {
+		codec = Gob
+	}
+	return &serverCodec{conn: conn, codec: codec}
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	m, err := readMessage(c.conn, HeaderChannel, -1)
+	if err != nil {
+		return err
+	}
+	c.id = m.ID
+	r.ServiceMethod = string(m.Data)
+	r.Seq = uint64(m.ID)
+	return nil
+}
+
+func (c *serverCodec) ReadRequestBody(body interface{}) error {
+	m, err := readMessage(c.conn, BodyChannel, c.id)
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		return nil
+	}
+	return c.codec.Unmarshal(m.Data, body)
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	var data []byte
+	if r.Error == "" {
+		var err error
+		if data, err = c.codec.Marshal(body); err != nil {
+			return err
+		}
+	}
+	header := appendString(nil, r.ServiceMethod)
+	header = appendString(header, r.Error)
+	id := int(r.Seq)
+	_, err := c.conn.Send(
+		binproto.NewMessage(id, HeaderChannel, header),
+		binproto.NewMessage(id, BodyChannel, data),
+	)
+	return err
+}
+
+func (c *serverCodec) Close() error {
+	return c.conn.Close()
+}
+
+// NewClient returns a new rpc.Client to handle requests to the set of
+// services at the other end of the connection.
+func NewClient(conn *binproto.Conn, codec Codec) *rpc.Client {
+	return rpc.NewClientWithCodec(NewClientCodec(conn, codec))
+}
+
+// Dial connects to an RPC server at the specified network address
+// and encodes bodies with Gob.
+func Dial(network, address string) (*rpc.Client, error) {
+	conn, err := binproto.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn, Gob), nil
+}
+
+// ServeConn runs the rpc.DefaultServer on a single connection.
+// ServeConn blocks, serving the connection until the client hangs up.
+func ServeConn(conn *binproto.Conn, codec Codec) {
+	rpc.ServeCodec(NewServerCodec(conn, codec))
+}
+
+// readMessage reads the next message and checks that it is on the
+// given channel and, unless id is negative, that it has the given ID.
+func readMessage(conn *binproto.Conn, ch rune, id int) (*binproto.Message, error) {
+	m, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if m.Channel != ch || (id >= 0 && m.ID != id) {
+		return nil, &binproto.MessageError{ID: m.ID, Channel: m.Channel, Err: ErrUnexpectedMessage}
+	}
+	return m, nil
+}
+
+func appendString(b []byte, s string) []byte {
+	var n [binary.MaxVarintLen64]byte
+	b = append(b, n[:binary.PutUvarint(n[:], uint64(len(s)))]...)
+	return append(b, s...)
+}
+
+func readString(b []byte) (string, []byte, error) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < l {
+		return "", nil, binproto.ErrMessageMalformed
+	}
+	return string(b[n : n+int(l)]), b[n+int(l):], nil
+}
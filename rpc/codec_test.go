@@ -0,0 +1,87 @@
+package rpc_test
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+
+	"github.com/onur1/binproto"
+	binrpc "github.com/onur1/binproto/rpc"
+	"github.com/stretchr/testify/assert"
+)
+
+type Args struct {
+	A, B int
+}
+
+type Arith int
+
+func (t *Arith) Add(args *Args, reply *int) error {
+	*reply = args.A + args.B
+	return nil
+}
+
+func (t *Arith) Div(args *Args, reply *int) error {
+	if args.B == 0 {
+		return errors.New("divide by zero")
+	}
+	*reply = args.A / args.B
+	return nil
+}
+
+type Echo int
+
+func (t *Echo) Upper(args []byte, reply *[]byte) error {
+	*reply = []byte(strings.ToUpper(string(args)))
+	return nil
+}
+
+func newTestClient(t *testing.T, codec binrpc.Codec) *rpc.Client {
+	s := rpc.NewServer()
+	assert.Nil(t, s.Register(new(Arith)))
+	assert.Nil(t, s.Register(new(Echo)))
+
+	a, b := net.Pipe()
+	go s.ServeCodec(binrpc.NewServerCodec(binproto.NewConn(b), codec))
+
+	return binrpc.NewClient(binproto.NewConn(a), codec)
+}
+
+func TestGob(t *testing.T) {
+	client := newTestClient(t, binrpc.Gob)
+	defer client.Close()
+
+	var reply int
+	assert.Nil(t, client.Call("Arith.Add", &Args{7, 8}, &reply))
+	assert.Equal(t, 15, reply)
+
+	err := client.Call("Arith.Div", &Args{7, 0}, &reply)
+	assert.Equal(t, rpc.ServerError("divide by zero"), err)
+
+	calls := make([]*rpc.Call, 10)
+	for i := range calls {
+		calls[i] = client.Go("Arith.Add", &Args{i, i}, new(int), nil)
+	}
+	for i, call := range calls {
+		<-call.Done
+		assert.Nil(t, call.Error)
+		assert.Equal(t, 2*i, *call.Reply.(*int))
+	}
+
+	err = client.Call("Arith.Mul", &Args{7, 8}, &reply)
+	assert.NotNil(t, err)
+}
+
+func TestBinary(t *testing.T) {
+	client := newTestClient(t, binrpc.Binary)
+	defer client.Close()
+
+	var reply []byte
+	assert.Nil(t, client.Call("Echo.Upper", []byte("hi"), &reply))
+	assert.Equal(t, "HI", string(reply))
+
+	err := client.Call("Arith.Add", &Args{7, 8}, new(int))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,131 @@
+package binproto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// In the self-synchronizing framing, every frame is followed by a CRC-32C
+// trailer as with checksums, and then COBS encoded, so that it contains
+// no zero bytes, and terminated with a zero byte. A reader which lost
+// track of the frame boundaries, or started reading in the middle of
+// a stream, finds the next frame after the next zero byte.
+const frameDelimiter = 0
+
+// appendCOBS appends the COBS encoding of src to dst.
+func appendCOBS(dst, src []byte) []byte {
+	codeAt := len(dst)
+	dst = append(dst, 0)
+	code := byte(1)
+	for _, c := range src {
+		if c == 0 {
+			dst[codeAt] = code
+			codeAt = len(dst)
+			dst = append(dst, 0)
+			code = 1
+			continue
+		}
+		dst = append(dst, c)
+		code++
+		if code == 0xff {
+			dst[codeAt] = code
+			codeAt = len(dst)
+			dst = append(dst, 0)
+			code = 1
+		}
+	}
+	dst[codeAt] = code
+	return dst
+}
+
+// decodeCOBS decodes the COBS encoded b in place, and reports
+// whether it was valid.
+func decodeCOBS(b []byte) ([]byte, bool) {
+	out := b[:0]
+	for i := 0; i < len(b); {
+		code := int(b[i])
+		if code == 0 || i+code > len(b) {
+			return nil, false
+		}
+		out = append(out, b[i+1:i+code]...)
+		i += code
+		if code < 0xff && i < len(b) {
+			out = append(out, 0)
+		}
+	}
+	return out, true
+}
+
+// readSync reads a message in the self-synchronizing framing,
+// skipping the frames which are not valid. The bytes of a frame read
+// before a timeout are kept, so that reading can be resumed.
+func (b *Reader) readSync() (*Message, error) {
+	for {
+		if i := bytes.IndexByte(b.buf[b.r:b.w], frameDelimiter); i >= 0 {
+			frame := b.buf[b.r : b.r+i]
+			b.r += i + 1
+			m, err := b.decodeSync(frame)
+			if m != nil || err != nil {
+				return m, err
+			}
+			b.skip(i + 1)
+			continue
+		}
+
+		if b.err != nil {
+			err := b.readErr()
+			if n := b.w - b.r; n > 0 && !isTimeout(err) {
+				b.r = b.w
+				b.skip(n)
+				if errors.Is(err, io.EOF) {
+					err = io.ErrUnexpectedEOF
+				}
+			}
+			return nil, err
+		}
+
+		b.compact()
+
+		// A frame which does not fit in the buffer is skipped,
+		// along with the rest of it up to the next delimiter.
+		if b.w == len(b.buf) && !b.grow(b.w+1) {
+			b.skip(b.w)
+			b.r, b.w = 0, 0
+		}
+
+		b.fill()
+	}
+}
+
+// decodeSync decodes a frame in the self-synchronizing framing. It returns
+// a nil message and a nil error if the frame is not valid.
+func (b *Reader) decodeSync(frame []byte) (*Message, error) {
+	data, ok := decodeCOBS(frame)
+	if !ok || len(data) == 0 {
+		return nil, nil
+	}
+	overhead := checksumSize
+	if b.compressed {
+		overhead++
+	}
+	m, n, err := DecodeMessage(data)
+	if err != nil || n != len(data) || len(m.Data)-overhead > b.d.maxMsg {
+		return nil, nil
+	}
+	if m.Data, err = verifyChecksum(m.ID, m.Channel, m.Data); err != nil {
+		return nil, nil
+	}
+	if b.compressed {
+		if err := b.decompressMessage(m); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (b *Reader) skip(n int) {
+	if b.onSkip != nil {
+		b.onSkip(n)
+	}
+}
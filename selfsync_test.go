@@ -0,0 +1,216 @@
+package binproto_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/onur1/binproto"
+	"github.com/stretchr/testify/assert"
+)
+
+func selfSyncMessages() []*binproto.Message {
+	return []*binproto.Message{
+		binproto.NewMessage(42, 3, make([]byte, 10)),
+		newMessage(7, 1, 254),
+		newMessage(7, 1, 600),
+		newMessage(0, 0, 0),
+		binproto.NewMessage(5, 10, []byte{0, 1, 0, 0, 2}),
+	}
+}
+
+func TestSelfSync(t *testing.T) {
+	var buf bytes.Buffer
+	w := binproto.NewWriterOptions(&buf, &binproto.WriterOptions{SelfSync: true})
+	assert.Nil(t, w.WriteMessage(selfSyncMessages()...))
+	assert.Nil(t, w.WriteMessageFrom(5, 10, 100, bytes.NewReader([]byte(fill(100)))))
+
+	// The only zero bytes are the delimiters.
+	assert.Equal(t, 6, bytes.Count(buf.Bytes(), []byte{0}))
+
+	r := binproto.NewReaderOptions(&buf, &binproto.ReaderOptions{
+		SelfSync: true,
+		OnSkip:   func(n int) { t.Fatalf("skipped %d bytes", n) },
+	})
+	for _, expected := range selfSyncMessages() {
+		m, err := r.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, expected.ID, m.ID)
+		assert.Equal(t, expected.Channel, m.Channel)
+		assert.Equal(t, string(expected.Data), string(m.Data))
+	}
+	m, body, err := r.NextMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, 5, m.ID)
+	data, _ := io.ReadAll(body)
+	assert.Equal(t, fill(100), string(data))
+
+	_, err = r.ReadMessage()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestSelfSyncRecovers(t *testing.T) {
+	var buf bytes.Buffer
+	w := binproto.NewWriterOptions(&buf, &binproto.WriterOptions{
+		SelfSync:    true,
+		Compressed:  true,
+		Compression: binproto.CompressionFlate,
+	})
+
+	var frames []int
+	for _, m := range []*binproto.Message{
+		newMessage(1, 1, 10),
+		newMessage(2, 2, 5000),
+		newMessage(3, 3, 10),
+		newMessage(4, 4, 10),
+		newMessage(5, 5, 10),
+	} {
+		n := buf.Len()
+		assert.Nil(t, w.WriteMessage(m))
+		frames = append(frames, buf.Len()-n)
+	}
+
+	data := buf.Bytes()
+	data[frames[0]+frames[1]+frames[2]/2] ^= 0x04 // corrupt the third frame
+	data = data[3:]                               // start in the middle of the first frame
+	data = data[:len(data)-frames[4]/2]           // truncate the last frame
+
+	var skipped []int
+	r := binproto.NewReaderOptions(bytes.NewReader(data), &binproto.ReaderOptions{
+		SelfSync:   true,
+		Compressed: true,
+		BufferSize: 16,
+		OnSkip:     func(n int) { skipped = append(skipped, n) },
+	})
+
+	m, err := r.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(2, 2, 5000), m)
+
+	m, err = r.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(4, 4, 10), m)
+
+	_, err = r.ReadMessage()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	assert.Equal(t, []int{frames[0] - 3, frames[2], frames[4] - frames[4]/2}, skipped)
+}
+
+func TestSelfSyncFrameTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	w := binproto.NewWriterOptions(&buf, &binproto.WriterOptions{SelfSync: true})
+	assert.Nil(t, w.WriteMessage(newMessage(1, 1, 100), newMessage(2, 2, 10)))
+
+	skipped := 0
+	r := binproto.NewReaderOptions(&buf, &binproto.ReaderOptions{
+		SelfSync:      true,
+		BufferSize:    16,
+		MaxBufferSize: 32,
+		OnSkip:        func(n int) { skipped += n },
+	})
+
+	m, err := r.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(2, 2, 10), m)
+	assert.Greater(t, skipped, 100)
+}
+
+func TestSelfSyncCompressedMaxMessageSize(t *testing.T) {
+	var buf bytes.Buffer
+	w := binproto.NewWriterOptions(&buf, &binproto.WriterOptions{
+		SelfSync:             true,
+		Compressed:           true,
+		Compression:          binproto.CompressionFlate,
+		CompressionThreshold: 1e4,
+	})
+	assert.Nil(t, w.WriteMessage(newMessage(1, 0, 1024), newMessage(2, 0, 1025), newMessage(3, 0, 10)))
+
+	skipped := 0
+	r := binproto.NewReaderOptions(&buf, &binproto.ReaderOptions{
+		SelfSync:       true,
+		Compressed:     true,
+		MaxMessageSize: 1024,
+		OnSkip:         func(n int) { skipped += n },
+	})
+	m, err := r.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(1, 0, 1024), m)
+	assert.Equal(t, 0, skipped)
+
+	m, err = r.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(3, 0, 10), m)
+	assert.Greater(t, skipped, 1025)
+}
+
+func TestConnSelfSync(t *testing.T) {
+	a, b := net.Pipe()
+	config := &binproto.ConnConfig{
+		Handshake:   true,
+		SelfSync:    true,
+		Compression: binproto.CompressionGzip,
+	}
+	c, d := binproto.NewConnConfig(a, config), binproto.NewConnConfig(b, config)
+	defer c.Close()
+	defer d.Close()
+
+	go c.Send(newMessage(42, 3, 2000))
+	m, err := d.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(42, 3, 2000), m)
+}
+
+func TestSelfSyncTimeout(t *testing.T) {
+	var buf bytes.Buffer
+	w := binproto.NewWriterOptions(&buf, &binproto.WriterOptions{SelfSync: true})
+	assert.Nil(t, w.WriteMessage(newMessage(1, 1, 100)))
+	frame := buf.Bytes()
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	r := binproto.NewReaderOptions(a, &binproto.ReaderOptions{
+		SelfSync: true,
+		OnSkip:   func(n int) { t.Errorf("skipped %d bytes", n) },
+	})
+
+	// The first half of the frame arrives before the deadline.
+	go b.Write(frame[:len(frame)/2])
+	a.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := r.ReadMessage()
+	assert.True(t, isTimeout(err))
+
+	a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	go b.Write(frame[len(frame)/2:])
+	m, err := r.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(1, 1, 100), m)
+}
+
+func TestSelfSyncWriteMessageFromTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	w := binproto.NewWriterOptions(&buf, &binproto.WriterOptions{
+		SelfSync:       true,
+		MaxMessageSize: 100,
+	})
+
+	assert.Nil(t, w.WriteMessageFrom(1, 1, 100, bytes.NewReader([]byte(fill(100)))))
+	n := buf.Len()
+
+	// Nothing is read nor written.
+	src := bytes.NewReader([]byte(fill(101)))
+	err := w.WriteMessageFrom(2, 1, 101, src)
+	var merr *binproto.MessageError
+	assert.True(t, errors.As(err, &merr))
+	assert.Equal(t, binproto.ErrMessageSizeExceeded, merr.Err)
+	assert.Equal(t, 101, src.Len())
+	assert.Equal(t, n, buf.Len())
+
+	err = w.WriteMessageFrom(2, 1, -1, src)
+	assert.True(t, errors.As(err, &merr))
+}
@@ -0,0 +1,289 @@
+package binproto
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Handler responds to a binproto message.
+//
+// ServeMessage should write reply messages to the Conn and then return.
+// Messages from a single connection are handled one at a time, in the
+// order they were received. If ServeMessage returns an error or panics,
+// the connection is closed.
+type Handler interface {
+	ServeMessage(c *Conn, m *Message) error
+}
+
+// The HandlerFunc type is an adapter to allow the use of ordinary
+// functions as binproto handlers.
+type HandlerFunc func(c *Conn, m *Message) error
+
+// ServeMessage calls f(c, m).
+func (f HandlerFunc) ServeMessage(c *Conn, m *Message) error {
+	return f(c, m)
+}
+
+// A connFinisher is a Handler which keeps state for each connection,
+// such as ServeMux. The Server calls finishConn when it stops reading
+// from a connection, before closing it.
+type connFinisher interface {
+	finishConn(c *Conn) error
+}
+
+// ErrServerClosed is returned by the Server's Serve and ListenAndServe
+// methods after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("binproto: Server closed")
+
+// A Server accepts binproto connections and dispatches the messages
+// read from them to a Handler.
+type Server struct {
+	Addr    string  // TCP address to listen on
+	Handler Handler // handler to invoke
+
+	// ConnConfig optionally configures the accepted connections.
+	// Its Dialer is not used.
+	ConnConfig *ConnConfig
+
+	// ErrorLog specifies an optional logger for errors accepting
+	// connections, unexpected behavior from handlers, and
+	// underlying connection errors.
+	// If nil, logging is done via the log package's standard logger.
+	ErrorLog *log.Logger
+
+	inShutdown int32
+
+	mu        sync.Mutex
+	listeners map[*net.Listener]struct{}
+	conns     map[*serverConn]struct{}
+}
+
+type serverConn struct {
+	srv *Server
+	rwc net.Conn
+	c   *Conn
+}
+
+// aLongTimeAgo is a non-zero time, far in the past, used for
+// immediate cancellation of network operations.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// ListenAndServe listens on the TCP network address s.Addr and then
+// calls Serve to handle incoming connections.
+//
+// ListenAndServe always returns a non-nil error. After Shutdown or Close,
+// the returned error is ErrServerClosed.
+func (s *Server) ListenAndServe() error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts incoming connections on the Listener l, creating a
+// new service goroutine for each. The service goroutines read messages
+// and then call s.Handler to reply to them.
+//
+// Serve always returns a non-nil error and closes l.
+// After Shutdown or Close, the returned error is ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(&l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(&l, false)
+	defer l.Close()
+
+	var tempDelay time.Duration
+
+	for {
+		rwc, err := l.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				s.logf("binproto: Accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+
+		sc := &serverConn{srv: s, rwc: rwc, c: NewConnConfig(rwc, s.ConnConfig)}
+		if !s.trackConn(sc, true) {
+			rwc.Close()
+			continue
+		}
+		go sc.serve()
+	}
+}
+
+// Shutdown gracefully shuts down the server without interrupting any
+// active handlers. Shutdown works by first closing all open listeners,
+// then interrupting reads on all connections so that no more messages
+// are dispatched, and then waiting for the handlers in progress to
+// return and their connections to be closed.
+//
+// If the provided context expires before the shutdown is complete,
+// Shutdown returns the context's error, otherwise it returns any
+// error returned from closing the Server's underlying Listener(s).
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.inShutdown, 1)
+
+	s.mu.Lock()
+	err := s.closeListenersLocked()
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		// Interrupt reads on every tick, as the read timeouts of
+		// a connection may have moved its deadline since.
+		if s.interruptConns() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// interruptConns interrupts reads on all connections,
+// and returns their number.
+func (s *Server) interruptConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sc := range s.conns {
+		sc.rwc.SetReadDeadline(aLongTimeAgo)
+	}
+	return len(s.conns)
+}
+
+// Close immediately closes all active listeners and connections.
+//
+// Close returns any error returned from closing the Server's
+// underlying Listener(s).
+func (s *Server) Close() error {
+	atomic.StoreInt32(&s.inShutdown, 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.closeListenersLocked()
+	for sc := range s.conns {
+		sc.c.Close()
+	}
+	return err
+}
+
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.inShutdown) != 0
+}
+
+func (s *Server) closeListenersLocked() error {
+	var err error
+	for l := range s.listeners {
+		if cerr := (*l).Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (s *Server) trackListener(l *net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[*net.Listener]struct{})
+	}
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+func (s *Server) trackConn(sc *serverConn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[*serverConn]struct{})
+	}
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.conns[sc] = struct{}{}
+	} else {
+		delete(s.conns, sc)
+	}
+	return true
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func (sc *serverConn) serve() {
+	var herr error
+
+	defer func() {
+		if err := recover(); err != nil {
+			const size = 64 << 10
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+			sc.srv.logf("binproto: panic serving %v: %v\n%s", sc.rwc.RemoteAddr(), err, buf)
+		}
+		if f, ok := sc.srv.Handler.(connFinisher); ok {
+			if err := f.finishConn(sc.c); err != nil && err != herr {
+				sc.srv.logf("binproto: error serving %v: %v", sc.rwc.RemoteAddr(), err)
+			}
+		}
+		sc.c.Close()
+		sc.srv.trackConn(sc, false)
+	}()
+
+	for {
+		m, err := sc.c.ReadMessage()
+		if err != nil {
+			if !sc.srv.shuttingDown() && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				sc.srv.logf("binproto: error reading from %v: %v", sc.rwc.RemoteAddr(), err)
+			}
+			return
+		}
+		if herr = sc.srv.Handler.ServeMessage(sc.c, m); herr != nil {
+			sc.srv.logf("binproto: error serving %v: %v", sc.rwc.RemoteAddr(), herr)
+			return
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package binproto_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/onur1/binproto"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer(t *testing.T, h binproto.Handler) (*binproto.Server, string, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &binproto.Server{
+		Handler:  h,
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(l)
+	}()
+	return s, l.Addr().String(), done
+}
+
+func TestServerShutdownWaitsForHandlers(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+
+	s, addr, done := newTestServer(t, binproto.HandlerFunc(func(c *binproto.Conn, m *binproto.Message) error {
+		close(started)
+		<-release
+		_, err := c.Send(m)
+		return err
+	}))
+
+	c, err := binproto.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	_, err = c.Send(newMessage(42, 3, 2))
+	assert.Nil(t, err)
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned before the handler")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+
+	m, err := c.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(42, 3, 2), m)
+
+	assert.Nil(t, <-shutdown)
+	assert.Equal(t, binproto.ErrServerClosed, <-done)
+
+	_, err = c.ReadMessage()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestServerShutdownContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	s, addr, _ := newTestServer(t, binproto.HandlerFunc(func(c *binproto.Conn, m *binproto.Message) error {
+		<-release
+		return nil
+	}))
+
+	c, err := binproto.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	_, err = c.Send(newMessage(42, 3, 2))
+	assert.Nil(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(ctx))
+}
+
+func TestServerRecoversPanic(t *testing.T) {
+	s, addr, _ := newTestServer(t, binproto.HandlerFunc(func(c *binproto.Conn, m *binproto.Message) error {
+		if m.Channel == 1 {
+			panic("boom")
+		}
+		_, err := c.Send(m)
+		return err
+	}))
+	defer s.Close()
+
+	c1, err := binproto.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c1.Close()
+
+	_, err = c1.Send(newMessage(42, 1, 2))
+	assert.Nil(t, err)
+	_, err = c1.ReadMessage()
+	assert.Equal(t, io.EOF, err)
+
+	c2, err := binproto.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c2.Close()
+
+	_, err = c2.Send(newMessage(42, 3, 2))
+	assert.Nil(t, err)
+	m, err := c2.ReadMessage()
+	assert.Nil(t, err)
+	assert.EqualValues(t, newMessage(42, 3, 2), m)
+}
+
+func TestServerClosed(t *testing.T) {
+	s := &binproto.Server{}
+	assert.Nil(t, s.Close())
+	assert.Equal(t, binproto.ErrServerClosed, s.ListenAndServe())
+}
+
+func TestServerOnClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{}, 2)
+	s := &binproto.Server{
+		Handler: binproto.HandlerFunc(func(c *binproto.Conn, m *binproto.Message) error {
+			_, err := c.Send(m)
+			return err
+		}),
+		ConnConfig: &binproto.ConnConfig{OnClose: func() { closed <- struct{}{} }},
+		ErrorLog:   log.New(ioutil.Discard, "", 0),
+	}
+	go s.Serve(l)
+
+	// The client disconnects.
+	c, err := binproto.Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	_, err = c.Send(newMessage(42, 3, 2))
+	assert.Nil(t, err)
+	_, err = c.ReadMessage()
+	assert.Nil(t, err)
+	c.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("OnClose not called after the client disconnected")
+	}
+
+	// The server closes.
+	c, err = binproto.Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	defer c.Close()
+	_, err = c.Send(newMessage(42, 3, 2))
+	assert.Nil(t, err)
+	_, err = c.ReadMessage()
+	assert.Nil(t, err)
+	assert.Nil(t, s.Close())
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("OnClose not called after the server closed")
+	}
+	select {
+	case <-closed:
+		t.Fatal("OnClose called twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,556 @@
+package binproto
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxUnacked   = 1024
+	defaultAckDelay     = 10 * time.Millisecond
+	sessionReadChanSize = 64
+)
+
+// ErrSessionResume is returned when the peers of a session cannot agree
+// on resuming it on a new connection, such as when one of them lost the
+// state of the session.
+var ErrSessionResume = errors.New("binproto: session resume failed")
+
+// ErrSessionExpired is returned by a Session which was closed after
+// being detached for longer than its IdleTimeout.
+var ErrSessionExpired = errors.New("binproto: session expired")
+
+// SessionConfig configures a Session.
+type SessionConfig struct {
+	// MaxUnacked is the number of sent messages kept until the peer
+	// acknowledges them, beyond which Send returns ErrQueueFull.
+	// If zero, 1024 is used.
+	MaxUnacked int
+
+	// AckDelay is how long received messages wait to be acknowledged,
+	// so that a single ack covers those arriving meanwhile.
+	// If zero, 10ms is used.
+	AckDelay time.Duration
+
+	// OnDetach, if not nil, is called with the error which ended the
+	// connection a Session was attached to.
+	OnDetach func(error)
+
+	// IdleTimeout, if not zero, closes a Session which stays detached
+	// for that long, dropping the messages waiting for an ack, and
+	// removes it from its SessionManager. Its methods then return
+	// ErrSessionExpired.
+	IdleTimeout time.Duration
+}
+
+// A Session delivers messages exactly once and in order, across any
+// number of connections attached to it one after the other.
+//
+// Messages are numbered in each direction, and kept after being sent
+// until the peer acknowledges them. When the session is attached to a
+// new connection, the peers exchange the number of the last message
+// they received, and send again only the messages which the other did
+// not receive. Duplicates are dropped on receipt.
+//
+// The client side of a session calls Attach with each new connection,
+// and the server side accepts them with a SessionManager. Both peers
+// must use the connections only through the Session.
+type Session struct {
+	id       uint64
+	config   SessionConfig
+	mgr      *SessionManager
+	messages chan *Message
+	done     chan struct{}
+	once     sync.Once
+
+	// wmu keeps messages on the wire in the order of their numbers,
+	// and rmu delivers them in that order across connections.
+	wmu sync.Mutex
+	rmu sync.Mutex
+
+	mu      sync.Mutex
+	conn    *Conn
+	stop    chan struct{} // closed when conn is detached
+	unacked []*Message    // framed messages sent after the last ack
+	acked   uint64        // number of the last acknowledged message
+	recvSeq uint64        // number of the last received message
+	idle    *time.Timer   // expires the session while detached
+	maxMsg  int           // negotiated MaxMessageSize of the last conn
+	err     error
+}
+
+// NewSession returns a new Session with a random ID, configured by
+// config. A nil config is equivalent to a zero SessionConfig.
+func NewSession(config *SessionConfig) *Session {
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			panic(err)
+		}
+		if id := binary.LittleEndian.Uint64(b[:]); id != 0 {
+			return newSession(id, config)
+		}
+	}
+}
+
+func newSession(id uint64, config *SessionConfig) *Session {
+	s := &Session{
+		id:       id,
+		messages: make(chan *Message, sessionReadChanSize),
+		done:     make(chan struct{}),
+	}
+	if config != nil {
+		s.config = *config
+	}
+	if s.config.MaxUnacked <= 0 {
+		s.config.MaxUnacked = defaultMaxUnacked
+	}
+	if s.config.AckDelay <= 0 {
+		s.config.AckDelay = defaultAckDelay
+	}
+	return s
+}
+
+// ID returns the ID of the session, which is shared by both peers.
+func (s *Session) ID() uint64 {
+	return s.id
+}
+
+// Attach resumes the session on c, replacing the connection it was
+// attached to, if any. It sends the messages which the peer has not
+// received yet before returning.
+func (s *Session) Attach(c *Conn) error {
+	s.detach(nil)
+	if err := c.writeControl(s.resumeMessage()); err != nil {
+		c.Close()
+		return err
+	}
+	id, recv, err := readResume(c)
+	if err == nil && id != s.id {
+		err = ErrSessionResume
+	}
+	if err != nil {
+		c.Close()
+		return err
+	}
+	return s.attach(c, recv)
+}
+
+// resumeMessage returns the message announcing the session and the
+// number of the last message received on it.
+func (s *Session) resumeMessage() *Message {
+	s.mu.Lock()
+	recv := s.recvSeq
+	s.mu.Unlock()
+	data := appendUvarint(nil, s.id)
+	data = appendUvarint(data, recv)
+	return NewMessage(controlID, controlResume, data)
+}
+
+// readResume reads the resume message of the peer from c.
+func readResume(c *Conn) (id, recv uint64, err error) {
+	m, err := c.ReadMessage()
+	if err != nil {
+		return 0, 0, err
+	}
+	if m.ID != controlID || m.Channel != controlResume {
+		return 0, 0, ErrSessionResume
+	}
+	id, n := binary.Uvarint(m.Data)
+	if n <= 0 || id == 0 {
+		return 0, 0, ErrSessionResume
+	}
+	recv, k := binary.Uvarint(m.Data[n:])
+	if k <= 0 {
+		return 0, 0, ErrSessionResume
+	}
+	return id, recv, nil
+}
+
+// attach makes c the connection of the session, once the peer told
+// the number of the last message it received.
+func (s *Session) attach(c *Conn, recv uint64) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.mu.Lock()
+	err := s.err
+	if err == nil && recv > s.sendSeqLocked() {
+		err = ErrSessionResume
+	}
+	if err != nil {
+		s.mu.Unlock()
+		c.Close()
+		return err
+	}
+	s.ackLocked(recv)
+	if s.idle != nil {
+		s.idle.Stop()
+		s.idle = nil
+	}
+	stop := make(chan struct{})
+	s.conn, s.stop = c, stop
+	if n, ok := c.Negotiated(); ok {
+		s.maxMsg = n.MaxMessageSize
+	}
+	pending := append([]*Message(nil), s.unacked...)
+	s.mu.Unlock()
+
+	go s.readLoop(c)
+	go s.ackLoop(c, stop)
+
+	if len(pending) > 0 {
+		if err := c.WriteMessage(pending...); err != nil {
+			var merr *MessageError
+			if errors.As(err, &merr) {
+				// It would be rejected again by every connection,
+				// and the messages after it can not be skipped.
+				s.close(err)
+				return err
+			}
+			s.detachConn(c, err)
+		}
+	}
+	return nil
+}
+
+// Send sends messages on the session. Messages sent while the session
+// is not attached are sent once it is. Send returns ErrQueueFull if
+// there are too many messages waiting for an ack.
+//
+// The largest ID is reserved for the control messages of the session,
+// and is rejected with ErrInvalidID. Messages rejected by the connection,
+// or larger than the MaxMessageSize negotiated on the last one, along
+// with the number prefixed to them, are not sent, and Send returns
+// a *MessageError. A message sent while detached which the next
+// connection rejects closes the session with the *MessageError.
+func (s *Session) Send(m ...*Message) error {
+	for i, msg := range m {
+		if err := msg.validate(); err != nil {
+			err.(*MessageError).Index = i
+			return err
+		}
+	}
+	// The session tells its control messages apart by their ID.
+	if err := reserveControlID(m); err != nil {
+		return err
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return s.err
+	}
+	if len(s.unacked)+len(m) > s.config.MaxUnacked {
+		s.mu.Unlock()
+		return ErrQueueFull
+	}
+	seq := s.sendSeqLocked()
+	framed := make([]*Message, len(m))
+	for i, msg := range m {
+		seq++
+		data := appendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(msg.Data)), seq)
+		framed[i] = NewMessage(msg.ID, msg.Channel, append(data, msg.Data...))
+		if s.maxMsg > 0 && len(framed[i].Data) > s.maxMsg {
+			s.mu.Unlock()
+			return &MessageError{Index: i, ID: msg.ID, Channel: msg.Channel, Err: ErrMessageSizeExceeded}
+		}
+	}
+	s.unacked = append(s.unacked, framed...)
+	c := s.conn
+	s.mu.Unlock()
+
+	if c != nil {
+		if err := c.WriteMessage(framed...); err != nil {
+			var merr *MessageError
+			if errors.As(err, &merr) {
+				// Nothing was written, and the messages are the
+				// last ones, as writes are ordered by wmu.
+				s.mu.Lock()
+				if n := len(s.unacked) - len(framed); n >= 0 {
+					s.unacked = s.unacked[:n]
+				}
+				s.mu.Unlock()
+				return err
+			}
+			// The messages are sent again on the next connection.
+			s.detachConn(c, err)
+		}
+	}
+	return nil
+}
+
+// ReadMessage returns the next message received on the session. It
+// blocks while the session is not attached, and only fails once the
+// session is closed.
+func (s *Session) ReadMessage() (*Message, error) {
+	select {
+	case m := <-s.messages:
+		return m, nil
+	case <-s.done:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return nil, s.err
+	}
+}
+
+// Close closes the session and the connection it is attached to,
+// and removes it from its SessionManager.
+func (s *Session) Close() error {
+	s.close(net.ErrClosed)
+	return nil
+}
+
+func (s *Session) close(err error) {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		s.unacked = nil
+		if s.idle != nil {
+			s.idle.Stop()
+			s.idle = nil
+		}
+		s.mu.Unlock()
+		close(s.done)
+	})
+	s.detach(nil)
+	if s.mgr != nil {
+		s.mgr.remove(s)
+	}
+}
+
+// expire closes the session unless it was attached meanwhile.
+func (s *Session) expire() {
+	s.mu.Lock()
+	attached := s.conn != nil
+	s.mu.Unlock()
+	if !attached {
+		s.close(ErrSessionExpired)
+	}
+}
+
+// ackLocked drops the messages acknowledged by the peer.
+func (s *Session) ackLocked(seq uint64) {
+	if seq <= s.acked {
+		return
+	}
+	n := int(seq - s.acked)
+	if n > len(s.unacked) {
+		n = len(s.unacked)
+	}
+	for i := range s.unacked[:n] {
+		s.unacked[i] = nil
+	}
+	s.unacked = s.unacked[n:]
+	s.acked = seq
+}
+
+// detach closes the current connection of the session, if any.
+func (s *Session) detach(err error) {
+	s.mu.Lock()
+	c := s.conn
+	s.mu.Unlock()
+	if c != nil {
+		s.detachConn(c, err)
+	}
+}
+
+// detachConn closes c if it is still the connection of the session,
+// and reports err to OnDetach.
+func (s *Session) detachConn(c *Conn, err error) {
+	s.mu.Lock()
+	if s.conn != c {
+		s.mu.Unlock()
+		return
+	}
+	s.conn = nil
+	close(s.stop)
+	s.stop = nil
+	if s.err == nil && s.config.IdleTimeout > 0 {
+		s.idle = time.AfterFunc(s.config.IdleTimeout, s.expire)
+	}
+	s.mu.Unlock()
+
+	c.Close()
+	if err != nil && s.config.OnDetach != nil {
+		s.config.OnDetach(err)
+	}
+}
+
+// readLoop delivers the messages read from c, until it fails.
+func (s *Session) readLoop(c *Conn) {
+	for {
+		m, err := c.ReadMessage()
+		if err != nil {
+			s.detachConn(c, err)
+			return
+		}
+
+		if m.ID == controlID {
+			if m.Channel == controlAck {
+				if seq, n := binary.Uvarint(m.Data); n > 0 {
+					s.mu.Lock()
+					if seq <= s.sendSeqLocked() {
+						s.ackLocked(seq)
+					}
+					s.mu.Unlock()
+				}
+			}
+			continue
+		}
+
+		seq, n := binary.Uvarint(m.Data)
+		if n <= 0 {
+			s.detachConn(c, ErrMessageMalformed)
+			return
+		}
+		m.Data = m.Data[n:]
+		if !s.deliver(c, seq, m) {
+			return
+		}
+	}
+}
+
+// deliver passes on m, numbered seq, unless it is a duplicate. It
+// reports whether c is still the connection of the session.
+func (s *Session) deliver(c *Conn, seq uint64, m *Message) bool {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+
+	s.mu.Lock()
+	if s.conn != c {
+		s.mu.Unlock()
+		return false
+	}
+	if seq <= s.recvSeq {
+		// Sent again after a resume.
+		s.mu.Unlock()
+		return true
+	}
+	if seq != s.recvSeq+1 {
+		s.mu.Unlock()
+		s.detachConn(c, ErrSessionResume)
+		return false
+	}
+	s.recvSeq = seq
+	s.mu.Unlock()
+
+	select {
+	case s.messages <- m:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// sendSeqLocked returns the number of the last sent message, which is
+// at least that of the last message the peer may acknowledge.
+func (s *Session) sendSeqLocked() uint64 {
+	return s.acked + uint64(len(s.unacked))
+}
+
+// ackLoop acknowledges the messages received on c every AckDelay,
+// until stop is closed. It writes apart from the read loop, so that
+// reading never waits on a write.
+func (s *Session) ackLoop(c *Conn, stop chan struct{}) {
+	t := time.NewTicker(s.config.AckDelay)
+	defer t.Stop()
+
+	var acked uint64
+	for {
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+		s.mu.Lock()
+		seq := s.recvSeq
+		s.mu.Unlock()
+		if seq == acked {
+			continue
+		}
+		if err := c.writeControl(NewMessage(controlID, controlAck, appendUvarint(nil, seq))); err != nil {
+			s.detachConn(c, err)
+			return
+		}
+		acked = seq
+	}
+}
+
+// A SessionManager accepts the server side of sessions, keeping them
+// across connections until they are closed.
+type SessionManager struct {
+	config *SessionConfig
+
+	mu       sync.Mutex
+	sessions map[uint64]*Session
+}
+
+// NewSessionManager returns a new SessionManager, whose sessions are
+// configured by config.
+func NewSessionManager(config *SessionConfig) *SessionManager {
+	return &SessionManager{
+		config:   config,
+		sessions: make(map[uint64]*Session),
+	}
+}
+
+// Accept reads the resume message sent by Attach on c, and attaches
+// the session it names to c, creating the session if it is new.
+// It reports whether the session existed before.
+//
+// Accept fails with ErrSessionResume if the peer resumes a session
+// which the manager does not know, as messages may have been lost.
+func (sm *SessionManager) Accept(c *Conn) (s *Session, resumed bool, err error) {
+	id, recv, err := readResume(c)
+	if err != nil {
+		c.Close()
+		return nil, false, err
+	}
+
+	sm.mu.Lock()
+	s, resumed = sm.sessions[id]
+	if !resumed {
+		if recv != 0 {
+			sm.mu.Unlock()
+			c.Close()
+			return nil, false, ErrSessionResume
+		}
+		s = newSession(id, sm.config)
+		s.mgr = sm
+		sm.sessions[id] = s
+	}
+	sm.mu.Unlock()
+
+	s.detach(nil)
+	if err := c.writeControl(s.resumeMessage()); err != nil {
+		c.Close()
+		return nil, false, err
+	}
+	if err := s.attach(c, recv); err != nil {
+		return nil, false, err
+	}
+	return s, resumed, nil
+}
+
+// Len returns the number of sessions of the manager.
+func (sm *SessionManager) Len() int {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return len(sm.sessions)
+}
+
+func (sm *SessionManager) remove(s *Session) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.sessions[s.id] == s {
+		delete(sm.sessions, s.id)
+	}
+}
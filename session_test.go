@@ -0,0 +1,258 @@
+package binproto_test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/onur1/binproto"
+	"github.com/stretchr/testify/assert"
+)
+
+// attachSession attaches the client session s to a new connection
+// accepted by sm, and returns the server side of the session.
+func attachSession(t *testing.T, s *binproto.Session, sm *binproto.SessionManager) (*binproto.Session, bool, net.Conn) {
+	t.Helper()
+
+	a, b := net.Pipe()
+	type accepted struct {
+		s       *binproto.Session
+		resumed bool
+		err     error
+	}
+	ch := make(chan accepted, 1)
+	go func() {
+		ss, resumed, err := sm.Accept(binproto.NewConn(b))
+		ch <- accepted{ss, resumed, err}
+	}()
+
+	assert.NoError(t, s.Attach(binproto.NewConn(a)))
+	res := <-ch
+	assert.NoError(t, res.err)
+	return res.s, res.resumed, a
+}
+
+func readSession(t *testing.T, s *binproto.Session, n int) []string {
+	t.Helper()
+
+	var got []string
+	for i := 0; i < n; i++ {
+		m, err := s.ReadMessage()
+		if !assert.NoError(t, err) {
+			break
+		}
+		got = append(got, string(m.Data))
+	}
+	return got
+}
+
+func TestSession(t *testing.T) {
+	sm := binproto.NewSessionManager(nil)
+	client := binproto.NewSession(nil)
+	defer client.Close()
+
+	server, resumed, _ := attachSession(t, client, sm)
+	defer server.Close()
+
+	assert.False(t, resumed)
+	assert.Equal(t, client.ID(), server.ID())
+	assert.Equal(t, 1, sm.Len())
+
+	assert.NoError(t, client.Send(
+		binproto.NewMessage(1, 1, []byte("foo")),
+		binproto.NewMessage(2, 2, []byte("bar")),
+	))
+	m, err := server.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, binproto.NewMessage(1, 1, []byte("foo")), m)
+	m, err = server.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, binproto.NewMessage(2, 2, []byte("bar")), m)
+
+	assert.NoError(t, server.Send(binproto.NewMessage(3, 3, []byte("qux"))))
+	m, err = client.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, binproto.NewMessage(3, 3, []byte("qux")), m)
+
+	server.Close()
+	assert.Equal(t, 0, sm.Len())
+	_, err = server.ReadMessage()
+	assert.ErrorIs(t, err, net.ErrClosed)
+	assert.ErrorIs(t, server.Send(binproto.NewMessage(1, 0, nil)), net.ErrClosed)
+}
+
+func TestSessionResume(t *testing.T) {
+	const total = 200
+
+	detached := make(chan error, 10)
+	config := &binproto.SessionConfig{
+		AckDelay: time.Millisecond,
+		OnDetach: func(err error) { detached <- err },
+	}
+	sm := binproto.NewSessionManager(config)
+	client := binproto.NewSession(config)
+	defer client.Close()
+
+	server, _, rwc := attachSession(t, client, sm)
+	defer server.Close()
+
+	done := make(chan []string, 1)
+	go func() {
+		done <- readSession(t, server, total)
+	}()
+
+	// Lose the connection while sending, and then keep sending
+	// while detached.
+	for i := 0; i < total; i++ {
+		if i == total/2 {
+			rwc.Close()
+			<-detached
+		}
+		assert.NoError(t, client.Send(binproto.NewMessage(1, 0, []byte(fmt.Sprint(i)))))
+	}
+
+	resumed, ok, _ := attachSession(t, client, sm)
+	assert.True(t, ok)
+	assert.Same(t, server, resumed)
+
+	want := make([]string, total)
+	for i := range want {
+		want[i] = fmt.Sprint(i)
+	}
+	assert.Equal(t, want, <-done)
+
+	// Nothing is delivered twice.
+	assert.NoError(t, client.Send(binproto.NewMessage(1, 0, []byte("last"))))
+	assert.Equal(t, []string{"last"}, readSession(t, server, 1))
+}
+
+func TestSessionResumeUnknown(t *testing.T) {
+	client := binproto.NewSession(nil)
+	defer client.Close()
+
+	sm := binproto.NewSessionManager(nil)
+	server, _, _ := attachSession(t, client, sm)
+	assert.NoError(t, server.Send(binproto.NewMessage(1, 0, []byte("foo"))))
+	assert.Equal(t, []string{"foo"}, readSession(t, client, 1))
+
+	// The state of the session is lost on the server.
+	other := binproto.NewSessionManager(nil)
+	a, b := net.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := other.Accept(binproto.NewConn(b))
+		errc <- err
+	}()
+	client.Attach(binproto.NewConn(a))
+	assert.ErrorIs(t, <-errc, binproto.ErrSessionResume)
+	assert.Equal(t, 0, other.Len())
+}
+
+func TestSessionControlID(t *testing.T) {
+	const controlID = 1<<60 - 1
+
+	config := &binproto.SessionConfig{MaxUnacked: 1, AckDelay: time.Millisecond}
+	client := binproto.NewSession(config)
+	defer client.Close()
+
+	err := client.Send(binproto.NewMessage(controlID, 0, nil))
+	var merr *binproto.MessageError
+	assert.ErrorAs(t, err, &merr)
+	assert.Equal(t, binproto.ErrInvalidID, merr.Err)
+
+	// Acks pass through connections handling control messages.
+	a, b := tcpPipe(t)
+	cc := &binproto.ConnConfig{KeepAlive: 5 * time.Millisecond}
+	sm := binproto.NewSessionManager(config)
+	accepted := make(chan *binproto.Session, 1)
+	go func() {
+		s, _, err := sm.Accept(binproto.NewConnConfig(b, cc))
+		assert.NoError(t, err)
+		accepted <- s
+	}()
+	assert.NoError(t, client.Attach(binproto.NewConnConfig(a, cc)))
+	server := <-accepted
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		assert.Eventually(t, func() bool {
+			return client.Send(binproto.NewMessage(i, 0, []byte("foo"))) == nil
+		}, time.Second, time.Millisecond)
+		m, err := server.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, i, m.ID)
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	config := &binproto.SessionConfig{IdleTimeout: 20 * time.Millisecond}
+	sm := binproto.NewSessionManager(config)
+	client := binproto.NewSession(nil)
+	defer client.Close()
+
+	server, _, rwc := attachSession(t, client, sm)
+	defer server.Close()
+
+	// Attached sessions never expire.
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, sm.Len())
+
+	rwc.Close()
+	assert.Eventually(t, func() bool {
+		return sm.Len() == 0
+	}, time.Second, 5*time.Millisecond)
+	_, err := server.ReadMessage()
+	assert.ErrorIs(t, err, binproto.ErrSessionExpired)
+	assert.ErrorIs(t, server.Send(binproto.NewMessage(1, 0, nil)), binproto.ErrSessionExpired)
+}
+
+func TestSessionMaxMessageSize(t *testing.T) {
+	detached := make(chan error, 10)
+	config := &binproto.SessionConfig{OnDetach: func(err error) { detached <- err }}
+	client := binproto.NewSession(config)
+	defer client.Close()
+
+	sm := binproto.NewSessionManager(nil)
+	attach := func(max int) (*binproto.Session, net.Conn, error) {
+		a, b := net.Pipe()
+		accepted := make(chan *binproto.Session, 1)
+		go func() {
+			s, _, _ := sm.Accept(binproto.NewConnConfig(b, &binproto.ConnConfig{
+				Handshake:      true,
+				MaxMessageSize: max,
+			}))
+			accepted <- s
+		}()
+		err := client.Attach(binproto.NewConnConfig(a, &binproto.ConnConfig{Handshake: true}))
+		return <-accepted, a, err
+	}
+
+	server, rwc, err := attach(100)
+	assert.NoError(t, err)
+	defer server.Close()
+
+	// The number prefixed to the message makes it too large.
+	err = client.Send(newMessage(1, 0, 10), newMessage(2, 0, 100))
+	var merr *binproto.MessageError
+	assert.ErrorAs(t, err, &merr)
+	assert.Equal(t, 1, merr.Index)
+	assert.Equal(t, binproto.ErrMessageSizeExceeded, merr.Err)
+
+	assert.NoError(t, client.Send(newMessage(3, 0, 99)))
+	m, err := server.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, m.ID)
+
+	// The limit of the last connection applies while detached.
+	rwc.Close()
+	<-detached
+	assert.ErrorAs(t, client.Send(newMessage(4, 0, 100)), &merr)
+	assert.NoError(t, client.Send(newMessage(5, 0, 80)))
+
+	// The next connection rejects it, which closes the session.
+	_, _, err = attach(50)
+	assert.ErrorAs(t, err, &merr)
+	_, err = client.ReadMessage()
+	assert.ErrorAs(t, err, &merr)
+}
@@ -0,0 +1,1053 @@
+package binproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMTU               = 1200
+	defaultUDPWindow         = 1024
+	defaultMaxResends        = 10
+	defaultReassemblyTimeout = 5 * time.Second
+	defaultListenerIdle      = 30 * time.Second
+	initialResendTimeout     = 100 * time.Millisecond
+	minResendTimeout         = 20 * time.Millisecond
+	maxResendTimeout         = 2 * time.Second
+	udpTickInterval          = 10 * time.Millisecond
+	udpAcceptQueueSize       = 64
+	maxUDPPacketSize         = 64 << 10
+
+	// udpHeaderSize bounds the size of the header of a data packet.
+	udpHeaderSize = 1 + 4*binary.MaxVarintLen64
+	// maxFragments bounds the number of fragments of a message.
+	maxFragments = 1 << 16
+	// maxPartials bounds the number of reliable messages, and that of
+	// unreliable ones, which are reassembled at the same time.
+	maxPartials = 256
+	// defaultMaxUDPConns bounds the connections of a UDPListener.
+	defaultMaxUDPConns = 1024
+	// ackBits is the number of packets following the first missing
+	// one which are selectively acknowledged.
+	ackBits = 64
+	// maxSequencedGap bounds how far ahead of the next expected one
+	// a sequenced message may be.
+	maxSequencedGap = 1 << 16
+	// seqdBits is the number of sequenced messages before the next
+	// expected one which are remembered, to tell those arriving late
+	// from duplicates.
+	seqdBits = 64
+)
+
+// The first byte of a datagram holds the kind of the packet, and for
+// data packets, the delivery class in its high 4 bits.
+const (
+	packetData byte = iota + 1
+	packetAck
+	packetClose
+	packetFEC
+	packetParity
+)
+
+// ErrInvalidDelivery is returned when sending with an unknown delivery class.
+var ErrInvalidDelivery = errors.New("binproto: invalid delivery class")
+
+// Delivery is the delivery class of a message sent over UDP.
+type Delivery uint8
+
+const (
+	// ReliableOrdered messages are sent again until they are
+	// acknowledged, and are read in the order they were sent.
+	ReliableOrdered Delivery = iota
+	// ReliableUnordered messages are sent again until they are
+	// acknowledged, and are read as soon as they are received.
+	ReliableUnordered
+	// Unreliable messages are sent once, and may be lost, duplicated
+	// or read out of order.
+	Unreliable
+	// Sequenced messages are sent once, and are dropped when they
+	// arrive after a newer message on their channel, so that only
+	// the latest state is read. Each channel is numbered apart, and
+	// a message more than 65536 ahead of the last one read is dropped.
+	Sequenced
+
+	numDeliveries
+)
+
+func (d Delivery) reliable() bool {
+	return d < Unreliable
+}
+
+// SequencedStats holds statistics of the messages received on a
+// channel with the Sequenced delivery class.
+type SequencedStats struct {
+	Received  int // messages read
+	Lost      int // messages skipped over, which never arrived
+	Reordered int // messages dropped as they arrived after a newer one
+
+	// Messages arriving more than 64 behind the latest one read are
+	// not told apart from duplicates, which are not counted, and
+	// remain lost.
+}
+
+// UDPConfig configures a UDPConn.
+type UDPConfig struct {
+	// MTU is the largest datagram sent. Larger messages are split into
+	// fragments, which are reassembled by the peer. If zero, 1200 is used.
+	MTU int
+
+	// Delivery is the delivery class of the messages sent by Send,
+	// indexed by their channel. The zero value is ReliableOrdered.
+	Delivery [maxChannel + 1]Delivery
+
+	// Window is the number of reliable packets which may be waiting for
+	// an ack, beyond which sending blocks. If zero, 1024 is used.
+	Window int
+
+	// MaxResends is the number of times a reliable packet is sent again
+	// without being acknowledged before the connection is closed, and
+	// its reads return ErrPeerTimeout. If zero, 10 is used.
+	MaxResends int
+
+	// IdleTimeout, if positive, closes a connection which receives
+	// nothing for that long, and its reads return ErrPeerTimeout.
+	// If zero, it is 30s for the connections of a UDPListener, so that
+	// peers which vanish do not keep their connections forever, and
+	// disabled for the others. A negative value disables it.
+	IdleTimeout time.Duration
+
+	// MaxMessageSize is the largest message which is reassembled.
+	// A larger reliable message closes the connection, and its reads
+	// return ErrMessageSizeExceeded. If zero, 8 MiB is used.
+	MaxMessageSize int
+
+	// ReassemblyTimeout is how long the fragments of an unreliable
+	// message are kept while the others are missing. If zero, 5s is used.
+	ReassemblyTimeout time.Duration
+
+	// MaxConns is the number of connections a UDPListener keeps at the
+	// same time, beyond which the datagrams of new peers are dropped.
+	// If zero, 1024 is used.
+	MaxConns int
+
+	// FEC is the number of datagrams, indexed by channel, after which
+	// a parity datagram is sent for the messages of the channel. It
+	// lets the peer rebuild one lost datagram of each group, without
+	// waiting for it to be sent again. If zero, no parity is sent.
+	// Values above 64 are lowered to 64.
+	FEC [maxChannel + 1]int
+}
+
+func (c *UDPConfig) setDefaults() {
+	if c.MTU <= udpHeaderSize {
+		c.MTU = defaultMTU
+	}
+	if c.Window <= 0 {
+		c.Window = defaultUDPWindow
+	}
+	if c.MaxResends <= 0 {
+		c.MaxResends = defaultMaxResends
+	}
+	if c.MaxMessageSize <= 0 {
+		c.MaxMessageSize = defaultMaxMessageSize
+	}
+	if c.ReassemblyTimeout <= 0 {
+		c.ReassemblyTimeout = defaultReassemblyTimeout
+	}
+	for i, n := range c.FEC {
+		if n > maxFECGroup {
+			c.FEC[i] = maxFECGroup
+		}
+	}
+}
+
+// A UDPConn exchanges messages with a single peer over UDP. Each
+// message travels in one or more datagrams, according to its delivery
+// class. Reliable packets are acknowledged with selective acks, and
+// sent again when their ack does not arrive in time.
+type UDPConn struct {
+	config  UDPConfig
+	local   net.Addr
+	remote  net.Addr
+	write   func([]byte) error
+	release func() error
+	notify  chan struct{} // signaled when messages are ready
+	done    chan struct{}
+	once    sync.Once
+
+	mu   sync.Mutex
+	cond *sync.Cond // signaled when the window opens or on close
+	err  error
+
+	// sending
+	nextSeq  uint64 // number of the next reliable packet
+	sendBase uint64 // no packet below is in flight
+	nextMsg  [numDeliveries]uint64
+	nextSeqd [maxChannel + 1]uint64 // numbers of sequenced messages
+	inflight map[uint64]*udpPacket
+	rtt      RTTStats
+	fecOut   [maxChannel + 1]*fecOutGroup
+	fecNext  [maxChannel + 1]uint64
+
+	// receiving
+	recvBase    uint64              // every reliable packet below is received
+	recvd       map[uint64]struct{} // received packets above recvBase
+	partials    map[partialKey]*partial
+	relPartials int                 // reliable messages in partials
+	nextOrdered uint64              // next ordered message to be read
+	held        map[uint64]*Message // ordered messages received early
+	ready       []*Message
+	lastRecv    time.Time
+	seqdNext    [maxChannel + 1]uint64 // next sequenced message expected
+	seqdRecvd   [maxChannel + 1]uint64 // bitmap of those received before
+	seqdStats   [maxChannel + 1]SequencedStats
+	fecIn       map[uint64]*fecGroup
+	fecStats    FECStats
+	broken      error // a reliable message can not be read
+}
+
+type udpPacket struct {
+	data    []byte
+	sent    time.Time
+	resends int
+}
+
+type partialKey struct {
+	d  Delivery
+	id uint64
+}
+
+type partial struct {
+	frags   map[int][]byte
+	count   int
+	size    int
+	created time.Time
+}
+
+func newUDPConn(local, remote net.Addr, config *UDPConfig, write func([]byte) error, release func() error) *UDPConn {
+	c := &UDPConn{
+		local:    local,
+		remote:   remote,
+		write:    write,
+		release:  release,
+		notify:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		inflight: make(map[uint64]*udpPacket),
+		recvd:    make(map[uint64]struct{}),
+		partials: make(map[partialKey]*partial),
+		held:     make(map[uint64]*Message),
+		fecIn:    make(map[uint64]*fecGroup),
+		lastRecv: time.Now(),
+	}
+	if config != nil {
+		c.config = *config
+	}
+	c.config.setDefaults()
+	c.cond = sync.NewCond(&c.mu)
+	go c.run()
+	return c
+}
+
+// DialUDP connects to the given address on the given UDP network.
+// A nil config is equivalent to a zero UDPConfig.
+//
+// No datagram is exchanged until a message is sent, so DialUDP
+// succeeds whether or not the peer is listening.
+func DialUDP(network, addr string, config *UDPConfig) (*UDPConn, error) {
+	raddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	uc, err := net.DialUDP(network, nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	c := newUDPConn(uc.LocalAddr(), uc.RemoteAddr(), config, func(b []byte) error {
+		_, err := uc.Write(b)
+		return err
+	}, uc.Close)
+
+	go func() {
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, err := uc.Read(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				// Such as ICMP port unreachable, while the peer
+				// is not listening yet.
+				continue
+			}
+			c.handle(buf[:n])
+		}
+	}()
+	return c, nil
+}
+
+// LocalAddr returns the local network address.
+func (c *UDPConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the network address of the peer.
+func (c *UDPConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// FECStats returns the forward error correction statistics of c.
+func (c *UDPConn) FECStats() FECStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fecStats
+}
+
+// SequencedStats returns the statistics of the sequenced messages
+// received on the channel ch.
+func (c *UDPConn) SequencedStats(ch rune) SequencedStats {
+	if ch < 0 || ch > maxChannel {
+		return SequencedStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seqdStats[ch]
+}
+
+// RTT returns the round-trip time statistics of c, measured with the
+// acks of reliable packets.
+func (c *UDPConn) RTT() RTTStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rtt
+}
+
+// Send sends messages with the delivery class of their channel.
+func (c *UDPConn) Send(m ...*Message) error {
+	for i, msg := range m {
+		if err := msg.validate(); err != nil {
+			err.(*MessageError).Index = i
+			return err
+		}
+	}
+	for _, msg := range m {
+		if err := c.send(c.config.Delivery[msg.Channel], msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendDelivery sends messages with the delivery class d.
+func (c *UDPConn) SendDelivery(d Delivery, m ...*Message) error {
+	if d >= numDeliveries {
+		return ErrInvalidDelivery
+	}
+	for i, msg := range m {
+		if err := msg.validate(); err != nil {
+			err.(*MessageError).Index = i
+			return err
+		}
+	}
+	for _, msg := range m {
+		if err := c.send(d, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send splits the encoding of m into fragments, and sends each in
+// a packet. Reliable packets are kept until they are acknowledged.
+func (c *UDPConn) send(d Delivery, m *Message) error {
+	if d >= numDeliveries {
+		return ErrInvalidDelivery
+	}
+	if len(m.Data) > c.config.MaxMessageSize {
+		return ErrMessageSizeExceeded
+	}
+	data, err := AppendMessage(nil, m)
+	if err != nil {
+		return err
+	}
+	fec := c.config.FEC[m.Channel] > 0
+	size := c.config.MTU - udpHeaderSize
+	if fec {
+		size -= fecHeaderSize
+	}
+	count := (len(data) + size - 1) / size
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	var id uint64
+	if d == Sequenced {
+		// The channel is needed to drop stale fragments, before
+		// the message is reassembled.
+		id = c.nextSeqd[m.Channel]<<4 | uint64(m.Channel)
+		c.nextSeqd[m.Channel]++
+	} else {
+		id = c.nextMsg[d]
+		c.nextMsg[d]++
+	}
+	c.mu.Unlock()
+
+	for i := 0; i < count; i++ {
+		frag := data[i*size:]
+		if len(frag) > size {
+			frag = frag[:size]
+		}
+		p := make([]byte, 0, udpHeaderSize+len(frag))
+		p = append(p, packetData|byte(d)<<4)
+
+		c.mu.Lock()
+		if d.reliable() {
+			for c.err == nil && len(c.inflight) >= c.config.Window {
+				c.cond.Wait()
+			}
+			if c.err != nil {
+				c.mu.Unlock()
+				return c.err
+			}
+			seq := c.nextSeq
+			c.nextSeq++
+			p = appendUvarint(p, seq)
+			p = appendFragment(p, id, i, count, frag)
+			// It is sent again as is, outside of any parity group.
+			c.inflight[seq] = &udpPacket{data: p, sent: time.Now()}
+		} else {
+			p = appendFragment(p, id, i, count, frag)
+		}
+		out := [][]byte{p}
+		if fec {
+			out = c.protect(m.Channel, p)
+		}
+		c.mu.Unlock()
+
+		for _, p := range out {
+			// A lost reliable packet is sent again.
+			if err := c.write(p); err != nil && !d.reliable() {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func appendFragment(p []byte, id uint64, index, count int, frag []byte) []byte {
+	p = appendUvarint(p, id)
+	p = appendUvarint(p, uint64(index))
+	p = appendUvarint(p, uint64(count))
+	return append(p, frag...)
+}
+
+// ReadMessage returns the next message received. After the peer closes
+// the connection, the messages already received are returned, and then
+// io.EOF.
+func (c *UDPConn) ReadMessage() (*Message, error) {
+	for {
+		c.mu.Lock()
+		if len(c.ready) > 0 {
+			m := c.ready[0]
+			c.ready[0] = nil
+			c.ready = c.ready[1:]
+			c.mu.Unlock()
+			return m, nil
+		}
+		err := c.err
+		c.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-c.notify:
+		case <-c.done:
+		}
+	}
+}
+
+// Close closes the connection, and tells the peer about it.
+func (c *UDPConn) Close() error {
+	c.fail(net.ErrClosed, true)
+	return nil
+}
+
+// fail closes c with err, which is returned by the later calls.
+func (c *UDPConn) fail(err error, notifyPeer bool) {
+	c.once.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.inflight = nil
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		close(c.done)
+
+		if notifyPeer {
+			c.write([]byte{packetClose})
+		}
+		c.release()
+	})
+}
+
+// run sends lost packets again, and expires stale fragments.
+func (c *UDPConn) run() {
+	t := time.NewTicker(udpTickInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-c.done:
+			return
+		}
+		if err := c.tick(time.Now()); err != nil {
+			c.fail(err, false)
+			return
+		}
+	}
+}
+
+func (c *UDPConn) tick(now time.Time) error {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil
+	}
+	if c.config.IdleTimeout > 0 && now.Sub(c.lastRecv) > c.config.IdleTimeout {
+		c.mu.Unlock()
+		return ErrPeerTimeout
+	}
+
+	rto := c.rto()
+	var resend [][]byte
+	for _, p := range c.inflight {
+		// Back off exponentially while a packet is lost.
+		timeout := rto << uint(p.resends)
+		if timeout > maxResendTimeout || timeout <= 0 {
+			timeout = maxResendTimeout
+		}
+		if now.Sub(p.sent) < timeout {
+			continue
+		}
+		if p.resends >= c.config.MaxResends {
+			c.mu.Unlock()
+			return ErrPeerTimeout
+		}
+		p.resends++
+		p.sent = now
+		resend = append(resend, p.data)
+	}
+	resend = append(resend, c.flushParity(now)...)
+	c.expireFEC(now)
+
+	for k, p := range c.partials {
+		if !k.d.reliable() && now.Sub(p.created) > c.config.ReassemblyTimeout {
+			delete(c.partials, k)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, p := range resend {
+		c.write(p)
+	}
+	return nil
+}
+
+// rto returns the retransmission timeout, computed as in RFC 6298.
+func (c *UDPConn) rto() time.Duration {
+	if c.rtt.Samples == 0 {
+		return initialResendTimeout
+	}
+	rto := c.rtt.Smoothed + 4*c.rtt.Variance
+	if rto < minResendTimeout {
+		rto = minResendTimeout
+	}
+	if rto > maxResendTimeout {
+		rto = maxResendTimeout
+	}
+	return rto
+}
+
+// handle processes a datagram received from the peer.
+func (c *UDPConn) handle(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.lastRecv = time.Now()
+
+	var ack []byte
+	n := len(c.ready)
+	switch b[0] & 0x0f {
+	case packetData:
+		ack = c.handleData(Delivery(b[0]>>4), b[1:])
+	case packetFEC:
+		ack = c.handleFEC(b[1:])
+	case packetParity:
+		ack = c.handleParity(b[1:])
+	case packetAck:
+		c.handleAck(b[1:])
+	case packetClose:
+		c.mu.Unlock()
+		c.fail(io.EOF, false)
+		return
+	}
+	ready, broken := len(c.ready) > n, c.broken
+	c.mu.Unlock()
+
+	if broken != nil {
+		// The peer would wait for the message to be read forever.
+		c.fail(broken, true)
+		return
+	}
+
+	if ack != nil {
+		c.write(ack)
+	}
+	if ready {
+		select {
+		case c.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// handleData processes a data packet, and returns the ack to send
+// for it, if any.
+func (c *UDPConn) handleData(d Delivery, b []byte) []byte {
+	if d >= numDeliveries {
+		return nil
+	}
+
+	var seq uint64
+	if d.reliable() {
+		var ok bool
+		if seq, b, ok = readUvarint(b); !ok {
+			return nil
+		}
+	}
+	id, b, ok := readUvarint(b)
+	if !ok {
+		return nil
+	}
+	index, b, ok := readUvarint(b)
+	if !ok {
+		return nil
+	}
+	count, b, ok := readUvarint(b)
+	if !ok || count == 0 || count > maxFragments || index >= count || len(b) == 0 {
+		return nil
+	}
+	// Fragments other than the last are as large as the others, which
+	// must not add up to more than the largest message.
+	if index+1 < count && (count-1)*uint64(len(b)) > uint64(c.config.MaxMessageSize+udpHeaderSize) {
+		if d.reliable() {
+			c.broken = ErrMessageSizeExceeded
+		}
+		return nil
+	}
+
+	k := partialKey{d, id}
+	if c.partialsFull(k, count) {
+		// A reliable packet is sent again, once the messages being
+		// reassembled are complete.
+		return nil
+	}
+
+	if d.reliable() {
+		if seq >= c.recvBase+uint64(c.config.Window)*2 {
+			// Too far ahead; it is sent again once acked packets
+			// make room.
+			return nil
+		}
+		if _, dup := c.recvd[seq]; dup || seq < c.recvBase {
+			return c.ackPacket()
+		}
+		c.recvd[seq] = struct{}{}
+		for {
+			if _, ok := c.recvd[c.recvBase]; !ok {
+				break
+			}
+			delete(c.recvd, c.recvBase)
+			c.recvBase++
+		}
+	}
+
+	if d == Sequenced && c.stale(k) {
+		return nil
+	}
+	data, err := c.reassemble(k, int(index), int(count), b)
+	if data != nil {
+		m, n, derr := DecodeMessage(data)
+		switch {
+		case derr != nil || n != len(data):
+			err = ErrMessageMalformed
+		case len(m.Data) > c.config.MaxMessageSize:
+			err = ErrMessageSizeExceeded
+		default:
+			c.deliver(d, id, m)
+		}
+	}
+
+	if !d.reliable() {
+		return nil
+	}
+	if err != nil {
+		c.broken = err
+		return nil
+	}
+	return c.ackPacket()
+}
+
+// stale reports whether the sequenced message of a fragment is older
+// than the latest one read on its channel, or too far ahead of it, and
+// drops the fragments already received of it. A message skipped over
+// is counted as reordered instead of lost by its first fragment
+// arriving late, while duplicates are not counted.
+func (c *UDPConn) stale(k partialKey) bool {
+	ch, seq := k.id&maxChannel, k.id>>4
+	next := c.seqdNext[ch]
+	if seq >= next {
+		return seq-next > maxSequencedGap
+	}
+	c.removePartial(k)
+	if behind := next - 1 - seq; behind < seqdBits && c.seqdRecvd[ch]&(1<<behind) == 0 {
+		c.seqdRecvd[ch] |= 1 << behind
+		s := &c.seqdStats[ch]
+		s.Reordered++
+		s.Lost--
+	}
+	return true
+}
+
+// partialsFull reports whether a fragment of count would begin the
+// reassembly of the message k while too many others of its kind are.
+func (c *UDPConn) partialsFull(k partialKey, count uint64) bool {
+	if count == 1 {
+		return false
+	}
+	if _, ok := c.partials[k]; ok {
+		return false
+	}
+	if k.d.reliable() {
+		return c.relPartials >= maxPartials
+	}
+	return len(c.partials)-c.relPartials >= maxPartials
+}
+
+// reassemble adds a fragment to the message it belongs to, and returns
+// the encoding of the message once it is complete, or an error if it
+// grows larger than MaxMessageSize.
+func (c *UDPConn) reassemble(k partialKey, index, count int, frag []byte) ([]byte, error) {
+	if count == 1 {
+		return frag, nil
+	}
+
+	p := c.partials[k]
+	if p == nil {
+		p = &partial{frags: make(map[int][]byte), count: count, created: time.Now()}
+		c.addPartial(k, p)
+	}
+	if p.count != count || p.frags[index] != nil {
+		return nil, nil
+	}
+	if p.size+len(frag) > c.config.MaxMessageSize+udpHeaderSize {
+		c.removePartial(k)
+		return nil, ErrMessageSizeExceeded
+	}
+	p.frags[index] = append([]byte(nil), frag...)
+	p.size += len(frag)
+	if len(p.frags) < count {
+		return nil, nil
+	}
+
+	c.removePartial(k)
+	data := make([]byte, 0, p.size)
+	for i := 0; i < count; i++ {
+		data = append(data, p.frags[i]...)
+	}
+	return data, nil
+}
+
+func (c *UDPConn) addPartial(k partialKey, p *partial) {
+	c.partials[k] = p
+	if k.d.reliable() {
+		c.relPartials++
+	}
+}
+
+func (c *UDPConn) removePartial(k partialKey) {
+	if _, ok := c.partials[k]; !ok {
+		return
+	}
+	delete(c.partials, k)
+	if k.d.reliable() {
+		c.relPartials--
+	}
+}
+
+// deliver makes m ready to be read, holding ordered messages back
+// until the ones before them are read.
+func (c *UDPConn) deliver(d Delivery, id uint64, m *Message) {
+	if d == Sequenced {
+		ch, seq := id&maxChannel, id>>4
+		s := &c.seqdStats[ch]
+		skipped := seq - c.seqdNext[ch]
+		s.Lost += int(skipped)
+		s.Received++
+		c.seqdNext[ch] = seq + 1
+		if skipped+1 < seqdBits {
+			c.seqdRecvd[ch] = c.seqdRecvd[ch]<<(skipped+1) | 1
+		} else {
+			c.seqdRecvd[ch] = 1
+		}
+	}
+	if d != ReliableOrdered {
+		c.ready = append(c.ready, m)
+		return
+	}
+	if id != c.nextOrdered {
+		if id > c.nextOrdered {
+			c.held[id] = m
+		}
+		return
+	}
+	c.ready = append(c.ready, m)
+	c.nextOrdered++
+	for {
+		m, ok := c.held[c.nextOrdered]
+		if !ok {
+			return
+		}
+		delete(c.held, c.nextOrdered)
+		c.ready = append(c.ready, m)
+		c.nextOrdered++
+	}
+}
+
+// ackPacket returns an ack of the reliable packets received, which
+// holds the number of the first missing packet, and a bitmap of the
+// ones received after it.
+func (c *UDPConn) ackPacket() []byte {
+	var mask uint64
+	for i := uint64(0); i < ackBits; i++ {
+		if _, ok := c.recvd[c.recvBase+1+i]; ok {
+			mask |= 1 << i
+		}
+	}
+	p := append(make([]byte, 0, 1+binary.MaxVarintLen64+8), packetAck)
+	p = appendUvarint(p, c.recvBase)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], mask)
+	return append(p, b[:]...)
+}
+
+// handleAck drops the packets acknowledged by the peer from the ones
+// in flight.
+func (c *UDPConn) handleAck(b []byte) {
+	base, b, ok := readUvarint(b)
+	if !ok || len(b) < 8 || base > c.nextSeq {
+		return
+	}
+	mask := binary.LittleEndian.Uint64(b)
+
+	now := time.Now()
+	var sample time.Duration
+	acked := func(seq uint64) {
+		p, ok := c.inflight[seq]
+		if !ok {
+			return
+		}
+		// Only packets sent once measure the RTT, as the ack of
+		// a packet sent again may be for any of its copies.
+		if p.resends == 0 {
+			sample = now.Sub(p.sent)
+		}
+		delete(c.inflight, seq)
+	}
+	for seq := c.sendBase; seq < base; seq++ {
+		acked(seq)
+	}
+	for i := uint64(0); i < ackBits && mask != 0; i++ {
+		if mask&(1<<i) != 0 {
+			acked(base + 1 + i)
+		}
+	}
+	if base > c.sendBase {
+		c.sendBase = base
+	}
+	if sample > 0 {
+		c.rtt.add(sample)
+	}
+	c.cond.Broadcast()
+}
+
+// readUvarint decodes a uvarint from the start of b, and returns the
+// bytes following it.
+func readUvarint(b []byte) (uint64, []byte, bool) {
+	x, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, b, false
+	}
+	return x, b[n:], true
+}
+
+// A UDPListener accepts UDPConns from the peers sending datagrams to
+// its address.
+type UDPListener struct {
+	pc       net.PacketConn
+	config   *UDPConfig
+	maxConns int
+	accept   chan *UDPConn
+	done     chan struct{}
+	once     sync.Once
+
+	mu    sync.Mutex
+	conns map[string]*UDPConn
+}
+
+// ListenUDP listens for datagrams on the given address and UDP network.
+// The accepted connections are configured by config.
+func ListenUDP(network, addr string, config *UDPConfig) (*UDPListener, error) {
+	laddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	l := &UDPListener{
+		pc:       pc,
+		config:   &UDPConfig{},
+		maxConns: defaultMaxUDPConns,
+		accept:   make(chan *UDPConn, udpAcceptQueueSize),
+		done:     make(chan struct{}),
+		conns:    make(map[string]*UDPConn),
+	}
+	if config != nil {
+		*l.config = *config
+	}
+	if l.config.MaxConns > 0 {
+		l.maxConns = l.config.MaxConns
+	}
+	if l.config.IdleTimeout == 0 {
+		l.config.IdleTimeout = defaultListenerIdle
+	}
+	go l.serve()
+	return l, nil
+}
+
+// Addr returns the address the listener listens on.
+func (l *UDPListener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+// Accept returns the connection of the next peer sending to the
+// listener.
+func (l *UDPListener) Accept() (*UDPConn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops listening, and closes the accepted connections.
+func (l *UDPListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+
+		// The conns are closed first, so that their peers are told.
+		l.mu.Lock()
+		conns := make([]*UDPConn, 0, len(l.conns))
+		for _, c := range l.conns {
+			conns = append(conns, c)
+		}
+		l.mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+		err = l.pc.Close()
+	})
+	return err
+}
+
+// serve dispatches the datagrams received to the connections of their
+// senders. A data packet from a new peer creates its connection, unless
+// there are MaxConns already.
+func (l *UDPListener) serve() {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if n == 0 {
+			continue
+		}
+
+		key := addr.String()
+		l.mu.Lock()
+		select {
+		case <-l.done:
+			// Close has taken the conns to close.
+			l.mu.Unlock()
+			return
+		default:
+		}
+		c, ok := l.conns[key]
+		if kind := buf[0] & 0x0f; !ok && (kind == packetData || kind == packetFEC) && len(l.conns) < l.maxConns {
+			c = l.newConn(key, addr)
+			l.conns[key] = c
+		}
+		l.mu.Unlock()
+		if c == nil {
+			continue
+		}
+		if !ok {
+			select {
+			case l.accept <- c:
+			default:
+				// The accept queue is full.
+				c.fail(net.ErrClosed, false)
+				continue
+			}
+		}
+		c.handle(buf[:n])
+	}
+}
+
+// newConn returns a new connection to addr, which is removed from
+// the listener once closed.
+func (l *UDPListener) newConn(key string, addr net.Addr) *UDPConn {
+	var c *UDPConn
+	c = newUDPConn(l.pc.LocalAddr(), addr, l.config, func(b []byte) error {
+		_, err := l.pc.WriteTo(b, addr)
+		return err
+	}, func() error {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.conns[key] == c {
+			delete(l.conns, key)
+		}
+		return nil
+	})
+	return c
+}
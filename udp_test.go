@@ -0,0 +1,568 @@
+package binproto_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/onur1/binproto"
+	"github.com/stretchr/testify/assert"
+)
+
+func listenUDP(t *testing.T, config *binproto.UDPConfig) *binproto.UDPListener {
+	t.Helper()
+	l, err := binproto.ListenUDP("udp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func dialUDP(t *testing.T, addr string, config *binproto.UDPConfig) *binproto.UDPConn {
+	t.Helper()
+	c, err := binproto.DialUDP("udp", addr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// udpProxy relays datagrams between a single client and target,
+// passing those from the client to up, and those from target to down,
+// along with the function sending them on. It returns the address
+// clients dial.
+func udpProxy(t *testing.T, target string, up, down func(p []byte, send func([]byte))) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := net.Dial("udp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		upstream.Close()
+	})
+
+	var (
+		mu     sync.Mutex
+		client net.Addr
+	)
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			client = addr
+			mu.Unlock()
+			up(buf[:n], func(p []byte) { upstream.Write(p) })
+		}
+	}()
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := upstream.Read(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				continue
+			}
+			mu.Lock()
+			addr := client
+			mu.Unlock()
+			down(buf[:n], func(p []byte) { pc.WriteTo(p, addr) })
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// lossyProxy is a udpProxy dropping the datagrams for which drop
+// returns true.
+func lossyProxy(t *testing.T, target string, drop func() bool) string {
+	relay := func(p []byte, send func([]byte)) {
+		if !drop() {
+			send(p)
+		}
+	}
+	return udpProxy(t, target, relay, relay)
+}
+
+// everyNth drops every nth datagram.
+func everyNth(n int) func() bool {
+	var (
+		mu sync.Mutex
+		i  int
+	)
+	return func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		i++
+		return i%n == 0
+	}
+}
+
+func TestUDP(t *testing.T) {
+	config := &binproto.UDPConfig{MTU: 256}
+	config.Delivery[2] = binproto.ReliableUnordered
+
+	l := listenUDP(t, config)
+	c := dialUDP(t, l.Addr().String(), config)
+
+	large := bytes.Repeat([]byte("0123456789"), 1000)
+	assert.NoError(t, c.Send(
+		binproto.NewMessage(1, 1, []byte("foo")),
+		binproto.NewMessage(2, 1, large),
+	))
+	assert.NoError(t, c.Send(binproto.NewMessage(3, 2, []byte("bar"))))
+
+	s, err := l.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, c.LocalAddr().String(), s.RemoteAddr().String())
+
+	got := make(map[int]*binproto.Message)
+	for i := 0; i < 3; i++ {
+		m, err := s.ReadMessage()
+		if !assert.NoError(t, err) {
+			return
+		}
+		got[m.ID] = m
+	}
+	assert.Equal(t, binproto.NewMessage(1, 1, []byte("foo")), got[1])
+	assert.Equal(t, binproto.NewMessage(2, 1, large), got[2])
+	assert.Equal(t, binproto.NewMessage(3, 2, []byte("bar")), got[3])
+
+	// Unreliable messages are very likely to arrive over loopback.
+	assert.NoError(t, s.SendDelivery(binproto.Unreliable, binproto.NewMessage(4, 3, large)))
+	m, err := c.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, binproto.NewMessage(4, 3, large), m)
+
+	assert.ErrorIs(t, c.SendDelivery(binproto.Delivery(15), m), binproto.ErrInvalidDelivery)
+	assert.ErrorIs(t, c.Send(binproto.NewMessage(1, 16, nil)), binproto.ErrInvalidChannel)
+
+	c.Close()
+	_, err = s.ReadMessage()
+	assert.ErrorIs(t, err, io.EOF)
+	_, err = c.ReadMessage()
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestUDPLoss(t *testing.T) {
+	// The drops follow a fixed pattern, which a packet sent again
+	// may keep running into when the tests are slowed down, as
+	// under the race detector, so it is given more tries.
+	withFEC := &binproto.UDPConfig{MTU: 512, MaxResends: 100}
+	withFEC.FEC[0] = 4
+
+	for name, config := range map[string]*binproto.UDPConfig{
+		"ARQ":     {MTU: 512, MaxResends: 100},
+		"ARQ+FEC": withFEC,
+	} {
+		t.Run(name, func(t *testing.T) {
+			testUDPLoss(t, config)
+		})
+	}
+}
+
+func testUDPLoss(t *testing.T, config *binproto.UDPConfig) {
+	const total = 200
+
+	l := listenUDP(t, config)
+	c := dialUDP(t, lossyProxy(t, l.Addr().String(), everyNth(4)), config)
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < total; i++ {
+			data := []byte(fmt.Sprint(i))
+			if i%10 == 0 {
+				data = bytes.Repeat(data, 1000)
+			}
+			if err := c.Send(binproto.NewMessage(i, 0, data)); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	s, err := l.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	for i := 0; i < total; i++ {
+		m, err := s.ReadMessage()
+		if !assert.NoError(t, err) {
+			return
+		}
+		want := []byte(fmt.Sprint(i))
+		if i%10 == 0 {
+			want = bytes.Repeat(want, 1000)
+		}
+		assert.Equal(t, binproto.NewMessage(i, 0, want), m)
+	}
+	assert.NoError(t, <-done)
+	assert.NotZero(t, c.RTT().Samples)
+}
+
+func TestUDPPeerTimeout(t *testing.T) {
+	l := listenUDP(t, nil)
+	c := dialUDP(t, lossyProxy(t, l.Addr().String(), func() bool { return true }), &binproto.UDPConfig{
+		MaxResends: 2,
+	})
+
+	assert.NoError(t, c.Send(binproto.NewMessage(1, 0, []byte("foo"))))
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.ReadMessage()
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		assert.ErrorIs(t, err, binproto.ErrPeerTimeout)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no timeout")
+	}
+}
+
+func TestUDPSequenced(t *testing.T) {
+	config := &binproto.UDPConfig{}
+	config.Delivery[5] = binproto.Sequenced
+
+	// Swap the second and third datagrams, and drop the fifth.
+	var (
+		i    int
+		held []byte
+	)
+	up := func(p []byte, send func([]byte)) {
+		switch i++; i {
+		case 2:
+			held = append([]byte(nil), p...)
+		case 3:
+			send(p)
+			send(held)
+		case 5:
+		default:
+			send(p)
+		}
+	}
+	pass := func(p []byte, send func([]byte)) { send(p) }
+
+	l := listenUDP(t, config)
+	c := dialUDP(t, udpProxy(t, l.Addr().String(), up, pass), config)
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, c.Send(binproto.NewMessage(i, 5, []byte("pos"))))
+	}
+
+	s, err := l.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	var ids []int
+	for len(ids) < 8 {
+		m, err := s.ReadMessage()
+		if !assert.NoError(t, err) {
+			return
+		}
+		ids = append(ids, m.ID)
+	}
+	assert.Equal(t, []int{0, 2, 3, 5, 6, 7, 8, 9}, ids)
+	assert.Equal(t, binproto.SequencedStats{
+		Received:  8,
+		Lost:      1,
+		Reordered: 1,
+	}, s.SequencedStats(5))
+	assert.Equal(t, binproto.SequencedStats{}, s.SequencedStats(0))
+}
+
+func TestUDPFEC(t *testing.T) {
+	config := &binproto.UDPConfig{ReassemblyTimeout: 50 * time.Millisecond}
+	config.Delivery[1] = binproto.Unreliable
+	config.FEC[1] = 4
+
+	// Drop one datagram of the first group, and two of the second.
+	var i int
+	up := func(p []byte, send func([]byte)) {
+		switch i++; i {
+		case 2, 7, 8:
+		default:
+			send(p)
+		}
+	}
+	pass := func(p []byte, send func([]byte)) { send(p) }
+
+	l := listenUDP(t, config)
+	c := dialUDP(t, udpProxy(t, l.Addr().String(), up, pass), config)
+
+	for i := 0; i < 8; i++ {
+		assert.NoError(t, c.Send(binproto.NewMessage(i, 1, []byte("state"))))
+	}
+
+	s, err := l.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	var ids []int
+	for len(ids) < 6 {
+		m, err := s.ReadMessage()
+		if !assert.NoError(t, err) {
+			return
+		}
+		ids = append(ids, m.ID)
+	}
+	assert.Equal(t, []int{0, 2, 3, 1, 4, 7}, ids)
+	assert.Eventually(t, func() bool {
+		return s.FECStats() == binproto.FECStats{Recovered: 1, Unrecoverable: 1}
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestUDPListenerMaxConns(t *testing.T) {
+	l := listenUDP(t, &binproto.UDPConfig{MaxConns: 1})
+	c1 := dialUDP(t, l.Addr().String(), nil)
+	c2 := dialUDP(t, l.Addr().String(), nil)
+
+	assert.NoError(t, c1.Send(binproto.NewMessage(1, 0, []byte("foo"))))
+	s1, err := l.Accept()
+	assert.NoError(t, err)
+	assert.NoError(t, c2.Send(binproto.NewMessage(2, 0, []byte("bar"))))
+
+	accepted := make(chan *binproto.UDPConn, 1)
+	go func() {
+		if s, err := l.Accept(); err == nil {
+			accepted <- s
+		}
+	}()
+	select {
+	case <-accepted:
+		t.Fatal("accepted beyond MaxConns")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The packet sent again gets through once there is room.
+	s1.Close()
+	select {
+	case s2 := <-accepted:
+		m, err := s2.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, binproto.NewMessage(2, 0, []byte("bar")), m)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not accepted")
+	}
+}
+
+// appendFragment appends a reliable data packet holding a fragment.
+func appendFragment(p []byte, seq, id, index, count uint64, frag []byte) []byte {
+	p = append(p, 1)
+	var b [binary.MaxVarintLen64]byte
+	for _, x := range []uint64{seq, id, index, count} {
+		p = append(p, b[:binary.PutUvarint(b[:], x)]...)
+	}
+	return append(p, frag...)
+}
+
+func TestUDPMaxMessageSizeMismatch(t *testing.T) {
+	l := listenUDP(t, &binproto.UDPConfig{MaxMessageSize: 4000})
+	c := dialUDP(t, l.Addr().String(), &binproto.UDPConfig{MaxMessageSize: 1 << 20})
+
+	assert.NoError(t, c.Send(binproto.NewMessage(1, 0, make([]byte, 10000))))
+	assert.NoError(t, c.Send(binproto.NewMessage(2, 0, []byte("foo"))))
+
+	s, err := l.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = s.ReadMessage()
+	assert.ErrorIs(t, err, binproto.ErrMessageSizeExceeded)
+
+	// The peer is told.
+	_, err = c.ReadMessage()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Error(t, c.Send(binproto.NewMessage(3, 0, []byte("bar"))))
+}
+
+func TestUDPPartialLimits(t *testing.T) {
+	l := listenUDP(t, &binproto.UDPConfig{MaxMessageSize: 1000})
+	raw, err := net.Dial("udp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	// reply returns the kind of the packet sent in reply to p, if any.
+	reply := func(p []byte) byte {
+		raw.Write(p)
+		raw.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		buf := make([]byte, 64)
+		if _, err := raw.Read(buf); err != nil {
+			return 0
+		}
+		return buf[0]
+	}
+	acked := func(p []byte) bool {
+		return reply(p) == 2
+	}
+
+	// The fragments of a message claim more than MaxMessageSize,
+	// which closes the connection.
+	assert.Equal(t, byte(3), reply(appendFragment(nil, 0, 0, 0, 100, make([]byte, 100))))
+
+	// The first fragments of many messages, which are never complete,
+	// each holding the first byte of an empty message.
+	var seq uint64
+	for ; seq < 256; seq++ {
+		if !assert.True(t, acked(appendFragment(nil, seq, seq, 0, 2, []byte{1}))) {
+			return
+		}
+	}
+	assert.False(t, acked(appendFragment(nil, seq, seq, 0, 2, []byte{1})))
+
+	// Completing a message makes room for another.
+	assert.True(t, acked(appendFragment(nil, seq, 0, 1, 2, []byte{0})))
+	assert.True(t, acked(appendFragment(nil, seq+1, seq, 0, 2, []byte{1})))
+}
+
+func TestUDPSequencedDuplicate(t *testing.T) {
+	config := &binproto.UDPConfig{}
+	config.Delivery[5] = binproto.Sequenced
+
+	// Hold the third datagram, and send the first one again after the
+	// fourth; send the third one twice once released, before the sixth.
+	var (
+		i           int
+		first, held []byte
+		release     = make(chan struct{})
+	)
+	up := func(p []byte, send func([]byte)) {
+		switch i++; i {
+		case 1:
+			first = append([]byte(nil), p...)
+			send(p)
+		case 3:
+			held = append([]byte(nil), p...)
+		case 4:
+			send(p)
+			send(first)
+		case 6:
+			<-release
+			send(held)
+			send(held)
+			send(p)
+		default:
+			send(p)
+		}
+	}
+	pass := func(p []byte, send func([]byte)) { send(p) }
+
+	l := listenUDP(t, config)
+	c := dialUDP(t, udpProxy(t, l.Addr().String(), up, pass), config)
+
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, c.Send(binproto.NewMessage(i, 5, []byte("pos"))))
+	}
+
+	s, err := l.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	read := func() int {
+		m, err := s.ReadMessage()
+		assert.NoError(t, err)
+		return m.ID
+	}
+	assert.Equal(t, []int{0, 1, 3, 4}, []int{read(), read(), read(), read()})
+	assert.Equal(t, binproto.SequencedStats{Received: 4, Lost: 1}, s.SequencedStats(5))
+	close(release)
+	assert.Equal(t, 5, read())
+	assert.Equal(t, binproto.SequencedStats{Received: 5, Reordered: 1}, s.SequencedStats(5))
+}
+
+func TestUDPSequencedGap(t *testing.T) {
+	config := &binproto.UDPConfig{}
+	config.Delivery[5] = binproto.Sequenced
+
+	l := listenUDP(t, config)
+	raw, err := net.Dial("udp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	send := func(seq uint64, id int) {
+		var b [binary.MaxVarintLen64]byte
+		p := []byte{1 | byte(binproto.Sequenced)<<4}
+		for _, x := range []uint64{seq<<4 | 5, 0, 1} {
+			p = append(p, b[:binary.PutUvarint(b[:], x)]...)
+		}
+		p, _ = binproto.AppendMessage(p, binproto.NewMessage(id, 5, []byte("pos")))
+		raw.Write(p)
+	}
+	send(0, 0)
+	send(1<<40, 1)
+	send(1, 2)
+
+	s, err := l.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, id := range []int{0, 2} {
+		m, err := s.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, id, m.ID)
+	}
+	assert.Equal(t, binproto.SequencedStats{Received: 2}, s.SequencedStats(5))
+}
+
+func TestUDPListenerClose(t *testing.T) {
+	l := listenUDP(t, nil)
+	c := dialUDP(t, l.Addr().String(), nil)
+
+	assert.NoError(t, c.Send(binproto.NewMessage(1, 0, []byte("foo"))))
+	s, err := l.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = s.ReadMessage()
+	assert.NoError(t, err)
+
+	// The peer is told.
+	assert.NoError(t, l.Close())
+	_, err = c.ReadMessage()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestUDPListenerIdleTimeout(t *testing.T) {
+	l := listenUDP(t, &binproto.UDPConfig{IdleTimeout: 50 * time.Millisecond})
+	raw, err := net.Dial("udp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	// The peer vanishes after a single datagram.
+	_, err = raw.Write(appendFragment(nil, 0, 0, 0, 1, []byte{1, 0}))
+	assert.NoError(t, err)
+	s, err := l.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = s.ReadMessage()
+	assert.NoError(t, err)
+	_, err = s.ReadMessage()
+	assert.ErrorIs(t, err, binproto.ErrPeerTimeout)
+}
@@ -36,3 +36,12 @@ func encodingLength(i uint64) int {
 	}
 	return 10
 }
+
+// appendUvarint appends the varint encoding of x to b.
+func appendUvarint(b []byte, x uint64) []byte {
+	for x >= 0x80 {
+		b = append(b, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(b, byte(x))
+}
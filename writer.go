@@ -2,75 +2,485 @@ package binproto
 
 import (
 	"bufio"
-	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync"
+	"time"
 )
 
 // A Writer implements convenience methods for writing
 // requests or responses to a binary protocol network connection.
 type Writer struct {
-	wd *bufio.Writer
+	mu         sync.Mutex
+	wd         *bufio.Writer
+	raw        io.Writer
+	buf        []byte
+	bufs       net.Buffers
+	splits     []int
+	vthreshold int
+	threshold  int
+	delay      time.Duration
+	timer      *time.Timer
+	err        error
+
+	compressed  bool
+	compression Compression
+	cthreshold  int
+	zbuf        []byte
+	checksum    bool
+	sync        bool
+	sbuf        []byte
+	maxSync     int
 }
 
+// maxRetainedBufSize is the largest scratch buffer a Writer keeps
+// between calls.
+const maxRetainedBufSize = 64 * 1024
+
+const defaultVectorThreshold = 1024
+
 // NewWriter returns a new Writer writing to w.
 func NewWriter(wd *bufio.Writer) *Writer {
 	return &Writer{wd: wd}
 }
 
-// WriteMessage writes a variable number of messages to w.
+// WriterOptions configures a Writer.
+type WriterOptions struct {
+	// BufferSize is the size of the write buffer.
+	// If zero, 4096 bytes are allocated.
+	BufferSize int
+
+	// CoalesceDelay enables write coalescing when greater than zero.
+	// WriteMessage then flushes only when at least CoalesceThreshold
+	// bytes are buffered, or when CoalesceDelay has passed since the
+	// first unflushed message was written, so that messages written
+	// in quick succession are sent together.
+	CoalesceDelay time.Duration
+
+	// CoalesceThreshold is the number of buffered bytes which cause
+	// an immediate flush when coalescing. If zero, BufferSize is used.
+	CoalesceThreshold int
+
+	// VectorThreshold is the payload size from which WriteMessage stops
+	// copying payloads into the write buffer. Instead, the buffered data
+	// is flushed, and then the headers and the payloads are written with
+	// a single net.Buffers.WriteTo call, which uses writev on connections
+	// that support it. If zero, 1024 bytes is used, if negative, payloads
+	// are always copied. Payloads are always copied with Compressed
+	// or SelfSync.
+	VectorThreshold int
+
+	// Compressed enables the compression framing, in which every payload
+	// starts with the Compression it was compressed with. The Reader at
+	// the other end must be configured with it as well.
+	Compressed bool
+
+	// Compression is the codec payloads of at least CompressionThreshold
+	// bytes are compressed with, if Compressed is set. If the compressed
+	// payload is not smaller, it is sent as-is. If CompressionThreshold
+	// is zero, 1024 bytes is used.
+	Compression          Compression
+	CompressionThreshold int
+
+	// Checksum appends a CRC-32C trailer to every frame, which the Reader
+	// at the other end, configured with it as well, verifies.
+	Checksum bool
+
+	// SelfSync enables the self-synchronizing framing, for lossy byte
+	// streams such as serial links. Every frame is checksummed as with
+	// Checksum, COBS encoded, and terminated with a zero byte, which
+	// the Reader at the other end, configured with it as well, uses
+	// to resume reading at the next frame after a corrupted one.
+	SelfSync bool
+
+	// MaxMessageSize is the largest payload WriteMessageFrom accepts
+	// with SelfSync, as the frame is then encoded as a whole in memory.
+	// If zero, 8 MiB is used.
+	MaxMessageSize int
+}
+
+// NewWriterOptions returns a new Writer writing to w, configured by opts.
+// A nil opts is equivalent to a zero WriterOptions.
+func NewWriterOptions(w io.Writer, opts *WriterOptions) *Writer {
+	nw := new(Writer)
+	nw.init(w, opts)
+	return nw
+}
+
+func (w *Writer) init(wr io.Writer, opts *WriterOptions) {
+	var o WriterOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.BufferSize <= 0 {
+		o.BufferSize = defaultBufSize
+	}
+	if o.CoalesceThreshold <= 0 || o.CoalesceThreshold > o.BufferSize {
+		o.CoalesceThreshold = o.BufferSize
+	}
+	if o.VectorThreshold == 0 {
+		o.VectorThreshold = defaultVectorThreshold
+	}
+	w.wd = bufio.NewWriterSize(wr, o.BufferSize)
+	if w.wd != wr {
+		w.raw = wr
+		w.vthreshold = o.VectorThreshold
+	}
+	if o.CoalesceDelay > 0 {
+		w.threshold = o.CoalesceThreshold
+		w.delay = o.CoalesceDelay
+	}
+	if o.Compressed {
+		w.setCompression(o.Compression, o.CompressionThreshold)
+	}
+	w.checksum = o.Checksum || o.SelfSync
+	w.sync = o.SelfSync
+	w.maxSync = o.MaxMessageSize
+	if w.maxSync <= 0 {
+		w.maxSync = defaultMaxMessageSize
+	}
+}
+
+// setCompression enables the compression framing.
+func (w *Writer) setCompression(c Compression, threshold int) {
+	if threshold <= 0 {
+		threshold = defaultCompressionThreshold
+	}
+	w.compressed = true
+	w.compression = c
+	w.cthreshold = threshold
+}
+
+// WriteMessage writes a variable number of messages to w and flushes
+// them, or, when write coalescing is enabled, schedules them to be
+// flushed.
+//
+// If any of the messages is not valid, nothing is written and
+// WriteMessage returns a *MessageError recording its position.
 func (w *Writer) WriteMessage(messages ...*Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.vectored(messages) {
+		return w.writeVectored(messages)
+	}
+
+	if err := w.write(messages); err != nil {
+		return err
+	}
+
+	if w.delay > 0 {
+		if w.wd.Buffered() < w.threshold {
+			if w.timer == nil && w.wd.Buffered() > 0 {
+				w.timer = time.AfterFunc(w.delay, w.flushDelayed)
+			}
+			return nil
+		}
+	}
+
+	return w.flush()
+}
+
+// Buffer writes a variable number of messages to the write buffer of w
+// without flushing them, parts of them are only written when the buffer
+// fills up. Flush writes the rest.
+//
+// If any of the messages is not valid, nothing is written and
+// Buffer returns a *MessageError recording its position.
+func (w *Writer) Buffer(messages ...*Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.write(messages)
+}
+
+// Flush writes any buffered data to the underlying io.Writer.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.flush()
+}
+
+func (w *Writer) flush() error {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if w.err != nil {
+		return w.err
+	}
+	return w.wd.Flush()
+}
+
+// flushDelayed flushes the messages which were held back by
+// coalescing. An error is kept by the bufio.Writer and returned
+// from the next write.
+func (w *Writer) flushDelayed() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.timer = nil
+	w.wd.Flush()
+}
+
+func (w *Writer) write(messages []*Message) error {
+	if w.err != nil {
+		return w.err
+	}
+
 	var err error
-	if len(messages) == 1 {
-		i := messages[0]
-		_, err = w.wd.Write(send(i.ID, i.Channel, i.Data))
-	} else {
-		_, err = w.wd.Write(sendBatch(messages))
+
+	buf := w.buf[:0]
+	for i, m := range messages {
+		if w.sync {
+			buf, err = w.appendSync(buf, m)
+		} else {
+			buf, err = w.appendFrame(buf, m)
+		}
+		if err != nil {
+			err.(*MessageError).Index = i
+			return err
+		}
+	}
+
+	_, err = w.wd.Write(buf)
+
+	if cap(buf) <= maxRetainedBufSize {
+		w.buf = buf
+	}
+
+	return err
+}
+
+// appendFrame appends m to dst, compressing its payload if it is
+// large enough and appending a checksum, if enabled.
+func (w *Writer) appendFrame(dst []byte, m *Message) ([]byte, error) {
+	if !w.compressed && !w.checksum {
+		return AppendMessage(dst, m)
+	}
+	if err := m.validate(); err != nil {
+		return dst, err
 	}
+
+	c, payload, size := CompressionNone, m.Data, 0
+	if w.compressed {
+		if w.compression != CompressionNone && len(m.Data) >= w.cthreshold {
+			comp := compressor(w.compression)
+			if comp == nil {
+				return dst, &MessageError{ID: m.ID, Channel: m.Channel, Err: ErrUnknownCompression}
+			}
+			z, err := comp.Compress(w.zbuf[:0], m.Data)
+			if err != nil {
+				return dst, &MessageError{ID: m.ID, Channel: m.Channel, Err: err}
+			}
+			if len(z) < len(m.Data) {
+				c, payload = w.compression, z
+			}
+			if cap(z) <= maxRetainedBufSize {
+				w.zbuf = z
+			}
+		}
+		size++
+	}
+	if w.checksum {
+		size += checksumSize
+	}
+
+	start := len(dst)
+	dst = appendHeader(dst, m.header(), size+len(payload))
+	if w.compressed {
+		dst = append(dst, byte(c))
+	}
+	dst = append(dst, payload...)
+	if w.checksum {
+		dst = appendChecksum(dst, crc32.Checksum(dst[start:], castagnoli))
+	}
+	return dst, nil
+}
+
+// appendSync appends m to dst in the self-synchronizing framing.
+func (w *Writer) appendSync(dst []byte, m *Message) ([]byte, error) {
+	frame, err := w.appendFrame(w.sbuf[:0], m)
 	if err != nil {
-		return err
+		return dst, err
+	}
+	if cap(frame) <= maxRetainedBufSize {
+		w.sbuf = frame
+	}
+	return append(appendCOBS(dst, frame), frameDelimiter), nil
+}
+
+// vectored reports whether any of the payloads should be written
+// without copying them.
+func (w *Writer) vectored(messages []*Message) bool {
+	if w.raw == nil || w.vthreshold <= 0 || w.compressed || w.sync {
+		return false
+	}
+	for _, m := range messages {
+		if len(m.Data) >= w.vthreshold {
+			return true
+		}
+	}
+	return false
+}
+
+// writeVectored writes the messages directly to the underlying
+// io.Writer, after the buffered data, without copying large payloads.
+func (w *Writer) writeVectored(messages []*Message) error {
+	if w.err != nil {
+		return w.err
 	}
 
-	if err := w.wd.Flush(); err != nil {
+	// Lay out the headers and the small payloads first, so that
+	// nothing is written when a message is not valid.
+	buf, splits := w.buf[:0], w.splits[:0]
+	for i, m := range messages {
+		if err := m.validate(); err != nil {
+			err.(*MessageError).Index = i
+			return err
+		}
+		if len(m.Data) < w.vthreshold {
+			buf, _ = w.appendFrame(buf, m)
+			continue
+		}
+		if !w.checksum {
+			buf = appendHeader(buf, m.header(), len(m.Data))
+			splits = append(splits, len(buf))
+			continue
+		}
+		// The trailer follows the payload.
+		start := len(buf)
+		buf = appendHeader(buf, m.header(), len(m.Data)+checksumSize)
+		splits = append(splits, len(buf))
+		crc := crc32.Update(crc32.Checksum(buf[start:], castagnoli), castagnoli, m.Data)
+		buf = appendChecksum(buf, crc)
+	}
+
+	if err := w.flush(); err != nil {
 		return err
 	}
 
-	return nil
-}
+	bufs, start, j := w.bufs[:0], 0, 0
+	for _, m := range messages {
+		if len(m.Data) >= w.vthreshold {
+			bufs = append(bufs, buf[start:splits[j]], m.Data)
+			start = splits[j]
+			j++
+		}
+	}
+	if start < len(buf) {
+		bufs = append(bufs, buf[start:])
+	}
 
-func send(id int, ch rune, data []byte) []byte {
-	header := uint64(id)<<4 | uint64(ch)
-	length := len(data) + encodingLength(header)
-	payload := make([]byte, encodingLength(uint64(length))+length)
+	w.bufs = bufs
+	_, err := w.bufs.WriteTo(w.raw)
+	if err != nil {
+		w.err = err
+	}
 
-	n := binary.PutUvarint(payload, uint64(length))
-	n += binary.PutUvarint(payload[n:], header)
-	copy(payload[n:], data)
+	// Do not keep references to the payloads.
+	for i := range bufs {
+		bufs[i] = nil
+	}
+	w.bufs = bufs[:0]
+	w.splits = splits[:0]
+	if cap(buf) <= maxRetainedBufSize {
+		w.buf = buf
+	}
 
-	return payload
+	return err
 }
 
-func sendBatch(items []*Message) []byte {
-	offset := 0
+// WriteMessageFrom writes a single message whose payload of the given
+// length is copied from r, without holding the payload in memory.
+//
+// If r returns fewer than length bytes, WriteMessageFrom returns
+// io.ErrUnexpectedEOF. In that case the message is incomplete and the
+// stream can not be used anymore.
+//
+// With SelfSync, a length above MaxMessageSize is rejected with a
+// *MessageError wrapping ErrMessageSizeExceeded, before reading r.
+func (w *Writer) WriteMessageFrom(id int, ch rune, length int, r io.Reader) error {
+	if err := validate(id, ch); err != nil {
+		return err
+	}
+	if length < 0 {
+		return &MessageError{ID: id, Channel: ch, Err: ErrMessageMalformed}
+	}
 
-	var length int
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	for _, v := range items {
-		// 16 is >= the max size of the varints
-		length += 16 + encodingLength(uint64(len(v.Data)))
+	if w.err != nil {
+		return w.err
 	}
 
-	payload := make([]byte, length)
+	if w.sync {
+		// Frames are encoded as a whole.
+		if length > w.maxSync {
+			return &MessageError{ID: id, Channel: ch, Err: ErrMessageSizeExceeded}
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if err := w.write([]*Message{NewMessage(id, ch, data)}); err != nil {
+			return err
+		}
+		return w.flush()
+	}
 
-	for _, v := range items {
-		header := uint64(v.ID<<4) | uint64(v.Channel)
-		l := uint64(len(v.Data) + encodingLength(header))
+	header := uint64(id)<<4 | uint64(ch)
 
-		offset += binary.PutUvarint(payload[offset:], l)
-		offset += binary.PutUvarint(payload[offset:], header)
+	size := length
+	if w.compressed {
+		size++
+	}
+	if w.checksum {
+		size += checksumSize
+	}
 
-		copy(payload[offset:], v.Data)
+	var hdr [2*maxVarintLen + 1]byte
+	b := appendHeader(hdr[:0], header, size)
+	if w.compressed {
+		// The payload is sent as-is.
+		b = append(b, byte(CompressionNone))
+	}
+
+	if _, err := w.wd.Write(b); err != nil {
+		return err
+	}
 
-		offset += len(v.Data)
+	if !w.checksum {
+		if err := copyFrom(w.wd, r, length); err != nil {
+			return err
+		}
+		return w.flush()
 	}
 
-	return payload[0:offset]
+	crc := crc32.New(castagnoli)
+	crc.Write(b)
+	if err := copyFrom(io.MultiWriter(w.wd, crc), r, length); err != nil {
+		return err
+	}
+	if _, err := w.wd.Write(appendChecksum(b[:0], crc.Sum32())); err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+func copyFrom(w io.Writer, r io.Reader, length int) error {
+	if _, err := io.CopyN(w, r, int64(length)); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
 }
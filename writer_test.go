@@ -3,7 +3,12 @@ package binproto_test
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/onur1/binproto"
 )
@@ -26,3 +31,219 @@ func TestSendBatch(t *testing.T) {
 		t.Fatalf("s=%q; err=%s", s, err)
 	}
 }
+
+func TestSendBatchLarge(t *testing.T) {
+	// Payloads larger than the varints of their frame, which once
+	// overflowed the buffer of a batch, around the sizes at which
+	// the varints grow.
+	var messages []*binproto.Message
+	for i, size := range []int{100, 1000, 10, 127, 128, 16383, 16384, 1 << 17} {
+		messages = append(messages, newMessage(i+1, rune(i%16), size))
+	}
+
+	var want bytes.Buffer
+	single := binproto.NewWriter(bufio.NewWriter(&want))
+	for _, m := range messages {
+		if err := single.WriteMessage(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	w := binproto.NewWriterOptions(&buf, &binproto.WriterOptions{VectorThreshold: -1})
+	if err := w.WriteMessage(messages...); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want.Bytes(), buf.Bytes()) {
+		t.Fatalf("batch of %d bytes; want %d", buf.Len(), want.Len())
+	}
+}
+
+func TestWriteMessageFrom(t *testing.T) {
+	var buf bytes.Buffer
+	w := binproto.NewWriter(bufio.NewWriter(&buf))
+	err := w.WriteMessageFrom(42, 3, 2, strings.NewReader("abc"))
+	if s := buf.String(); s != "\x04\xa3\x05ab" || err != nil {
+		t.Fatalf("s=%q; err=%s", s, err)
+	}
+
+	err = w.WriteMessageFrom(42, 3, 4, strings.NewReader("abc"))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("err=%s", err)
+	}
+}
+
+func TestSendInvalid(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		messages []*binproto.Message
+		index    int
+		err      error
+	}{
+		{
+			desc:     "negative ID",
+			messages: []*binproto.Message{newMessage(-1, 3, 2)},
+			err:      binproto.ErrInvalidID,
+		},
+		{
+			desc:     "ID too big",
+			messages: []*binproto.Message{newMessage(maxID+1, 3, 2)},
+			err:      binproto.ErrInvalidID,
+		},
+		{
+			desc:     "negative channel",
+			messages: []*binproto.Message{newMessage(42, -1, 2)},
+			err:      binproto.ErrInvalidChannel,
+		},
+		{
+			desc:     "channel too big",
+			messages: []*binproto.Message{newMessage(42, 16, 2)},
+			err:      binproto.ErrInvalidChannel,
+		},
+		{
+			desc:     "batch",
+			messages: []*binproto.Message{newMessage(42, 3, 2), newMessage(42, 3, 2), newMessage(42, 16, 2)},
+			index:    2,
+			err:      binproto.ErrInvalidChannel,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := binproto.NewWriter(bufio.NewWriter(&buf))
+			err := w.WriteMessage(tt.messages...)
+			var merr *binproto.MessageError
+			if !errors.As(err, &merr) || merr.Err != tt.err || merr.Index != tt.index {
+				t.Fatalf("err=%#v", err)
+			}
+			if buf.Len() != 0 {
+				t.Fatalf("s=%q", buf.String())
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	w := binproto.NewWriter(bufio.NewWriter(&buf))
+	if err := w.WriteMessageFrom(-1, 3, 2, strings.NewReader("ab")); !errors.Is(err, binproto.ErrInvalidID) {
+		t.Fatalf("err=%s", err)
+	}
+}
+
+type countingWriter struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes++
+	return w.buf.Write(p)
+}
+
+func (w *countingWriter) stats() (string, int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String(), w.writes
+}
+
+func TestBuffer(t *testing.T) {
+	var cw countingWriter
+	w := binproto.NewWriterOptions(&cw, nil)
+	msg := newMessage(42, 3, 2)
+	for i := 0; i < 3; i++ {
+		if err := w.Buffer(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s, n := cw.stats(); s != "" || n != 0 {
+		t.Fatalf("s=%q; writes=%d", s, n)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if s, n := cw.stats(); s != strings.Repeat("\x04\xa3\x05ab", 3) || n != 1 {
+		t.Fatalf("s=%q; writes=%d", s, n)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	var cw countingWriter
+	w := binproto.NewWriterOptions(&cw, &binproto.WriterOptions{
+		CoalesceDelay:     20 * time.Millisecond,
+		CoalesceThreshold: 16,
+	})
+	msg := newMessage(42, 3, 2)
+
+	// Below the threshold, wait for the delay.
+	for i := 0; i < 2; i++ {
+		if err := w.WriteMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s, n := cw.stats(); s != "" || n != 0 {
+		t.Fatalf("s=%q; writes=%d", s, n)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if s, n := cw.stats(); s != strings.Repeat("\x04\xa3\x05ab", 2) || n != 1 {
+		t.Fatalf("s=%q; writes=%d", s, n)
+	}
+
+	// Reaching the threshold flushes immediately.
+	if err := w.WriteMessage(msg, msg, msg, msg); err != nil {
+		t.Fatal(err)
+	}
+	if s, n := cw.stats(); s != strings.Repeat("\x04\xa3\x05ab", 6) || n != 2 {
+		t.Fatalf("s=%q; writes=%d", s, n)
+	}
+}
+
+type payloadWriter struct {
+	bytes.Buffer
+	payload []byte
+	direct  bool
+}
+
+func (w *payloadWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 && &p[0] == &w.payload[0] {
+		w.direct = true
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestWriteVectored(t *testing.T) {
+	large := newMessage(7, 1, 2048)
+	small := newMessage(42, 3, 2)
+
+	var want bytes.Buffer
+	ww := binproto.NewWriterOptions(&want, &binproto.WriterOptions{VectorThreshold: -1})
+	if err := ww.WriteMessage(small, large, small); err != nil {
+		t.Fatal(err)
+	}
+
+	pw := &payloadWriter{payload: large.Data}
+	w := binproto.NewWriterOptions(pw, nil)
+	if err := w.Buffer(small); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteMessage(large, small); err != nil {
+		t.Fatal(err)
+	}
+	if !pw.direct {
+		t.Fatal("payload was copied")
+	}
+	if !bytes.Equal(want.Bytes(), pw.Bytes()) {
+		t.Fatalf("got %q; want %q", pw.Bytes(), want.Bytes())
+	}
+
+	// Nothing is written for an invalid batch.
+	pw.Reset()
+	err := w.WriteMessage(large, newMessage(-1, 0, 0))
+	var merr *binproto.MessageError
+	if !errors.As(err, &merr) || merr.Index != 1 || pw.Len() != 0 {
+		t.Fatalf("err=%v; written=%d", err, pw.Len())
+	}
+}